@@ -0,0 +1,148 @@
+package collectors
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "runtime"
+import "strconv"
+import "strings"
+import "time"
+import "github.com/mike-a-davis/metricsd/mappings"
+import "github.com/mike-a-davis/metricsd/stats"
+import "github.com/mike-a-davis/metricsd/structs"
+import "github.com/vaughan0/go-ini"
+
+var agentPathReplacer = strings.NewReplacer(".", "_", "/", "_", ":", "_", " ", "_")
+
+// AgentCollector is an exported type that
+// allows collecting metrics for metricsd itself
+type AgentCollector struct {
+	enabled bool
+}
+
+func init() {
+	Register("AgentCollector", func(_ string) CollectorInterface {
+		return &AgentCollector{}
+	})
+}
+
+// Enabled allows checking whether the collector is enabled or not
+func (c *AgentCollector) Enabled() bool {
+	return c.enabled
+}
+
+// State allows setting the enabled state of the collector
+func (c *AgentCollector) State(state bool) {
+	c.enabled = state
+}
+
+// Setup configures the collector
+func (c *AgentCollector) Setup(conf ini.File) {
+	c.State(true)
+}
+
+// Report collects a list of MetricSlices for upstream reporting
+func (c *AgentCollector) Report() (structs.MetricSlice, error) {
+	var report structs.MetricSlice
+
+	for name, s := range stats.Collectors() {
+		report = c.appendMetrics(report, "collectors", "collector", name, mappings.MetricMap{
+			"runs":        s.Runs,
+			"errors":      s.Errors,
+			"metrics":     s.Metrics,
+			"duration_ms": s.Duration.Seconds() * 1000,
+		})
+	}
+
+	for name, s := range stats.Shippers() {
+		lag := 0.0
+		if !s.Oldest.IsZero() {
+			lag = time.Since(s.Oldest).Seconds()
+		}
+
+		report = c.appendMetrics(report, "shippers", "shipper", name, mappings.MetricMap{
+			"batches":     s.Batches,
+			"failures":    s.Failures,
+			"dropped":     s.Dropped,
+			"spooled":     s.Spooled,
+			"queue_depth": s.QueueDepth,
+			"lag_seconds": lag,
+			"latency_ms":  s.Latency.Seconds() * 1000,
+		})
+	}
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	lastPause := memStats.PauseNs[(memStats.NumGC+255)%256]
+	report = c.appendMetrics(report, "runtime", "", "", mappings.MetricMap{
+		"goroutines":        runtime.NumGoroutine(),
+		"heap_alloc":        memStats.HeapAlloc,
+		"heap_inuse":        memStats.HeapInuse,
+		"heap_sys":          memStats.HeapSys,
+		"heap_objects":      memStats.HeapObjects,
+		"gc_count":          memStats.NumGC,
+		"gc_pause_ms":       float64(lastPause) / 1e6,
+		"gc_pause_total_ms": float64(memStats.PauseTotalNs) / 1e6,
+	})
+
+	process := mappings.MetricMap{}
+	rss, err := readRss()
+	if err == nil {
+		process["rss"] = rss
+	}
+	fds, fdErr := ioutil.ReadDir("/proc/self/fd")
+	if fdErr == nil {
+		process["open_fds"] = len(fds)
+	} else if err == nil {
+		err = fdErr
+	}
+	report = c.appendMetrics(report, "process", "", "", process)
+
+	return report, err
+}
+
+func (c *AgentCollector) appendMetrics(report structs.MetricSlice, group string, field string, name string, values mappings.MetricMap) structs.MetricSlice {
+	path := fmt.Sprintf("agent.%s", group)
+	if name != "" {
+		path = fmt.Sprintf("%s.%s", path, agentPathReplacer.Replace(name))
+	}
+
+	for k, v := range values {
+		metricType := "gauge"
+		if k == "runs" || k == "errors" || k == "batches" || k == "failures" || k == "dropped" || k == "spooled" || k == "gc_count" {
+			metricType = "rate"
+		}
+
+		data := structs.FieldsMap{
+			"name": k,
+		}
+		if field != "" {
+			data[field] = name
+		}
+
+		metric := structs.BuildMetric("AgentCollector", "agent", metricType, k, v, data)
+		metric.Path = path
+		report = append(report, metric)
+	}
+
+	return report
+}
+
+// readRss returns the resident set size of this process in bytes
+func readRss() (int64, error) {
+	statm, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("unexpected /proc/self/statm format")
+	}
+
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return pages * int64(os.Getpagesize()), nil
+}
@@ -4,13 +4,18 @@ import "fmt"
 import "github.com/c9s/goprocinfo/linux"
 import "github.com/mike-a-davis/metricsd/mappings"
 import "github.com/mike-a-davis/metricsd/structs"
-import "github.com/Sirupsen/logrus"
 import "github.com/vaughan0/go-ini"
 
 type CpuCollector struct {
 	enabled bool
 }
 
+func init() {
+	Register("CpuCollector", func(_ string) CollectorInterface {
+		return &CpuCollector{}
+	})
+}
+
 func (c *CpuCollector) Enabled() bool {
 	return c.enabled
 }
@@ -25,7 +30,7 @@ func (c *CpuCollector) Setup(conf ini.File) {
 
 func (c *CpuCollector) Report() (structs.MetricSlice, error) {
 	var report structs.MetricSlice
-	data, _ := c.collect()
+	data, err := c.collect()
 
 	if data != nil {
 		for cpu, values := range data {
@@ -42,14 +47,13 @@ func (c *CpuCollector) Report() (structs.MetricSlice, error) {
 		}
 	}
 
-	return report, nil
+	return report, err
 }
 
 func (c *CpuCollector) collect() (map[string]mappings.MetricMap, error) {
 	stat, err := linux.ReadStat("/proc/stat")
 	if err != nil {
-		logrus.Fatal("stat read fail")
-		return nil, err
+		return nil, fmt.Errorf("stat read fail: %v", err)
 	}
 
 	cpuMapping := map[string]mappings.MetricMap{}
@@ -9,13 +9,19 @@ import "syscall"
 import "github.com/c9s/goprocinfo/linux"
 import "github.com/mike-a-davis/metricsd/mappings"
 import "github.com/mike-a-davis/metricsd/structs"
-import "github.com/Sirupsen/logrus"
 import "github.com/vaughan0/go-ini"
 
 type DiskspaceCollector struct {
 	enabled        bool
 	excludeFilters []string
 	filesystems    map[string]bool
+	section        string
+}
+
+func init() {
+	Register("DiskspaceCollector", func(section string) CollectorInterface {
+		return &DiskspaceCollector{section: section}
+	})
 }
 
 func (c *DiskspaceCollector) Enabled() bool {
@@ -30,7 +36,7 @@ func (c *DiskspaceCollector) Setup(conf ini.File) {
 	c.State(true)
 	c.setFilesystems(conf)
 
-	ef, ok := conf.Get("DiskspaceCollector", "exclude_filters")
+	ef, ok := conf.Get(c.section, "exclude_filters")
 	if ok {
 		excludeFilters := strings.Split(ef, ",")
 		for _, excludeFilter := range excludeFilters {
@@ -41,7 +47,7 @@ func (c *DiskspaceCollector) Setup(conf ini.File) {
 
 func (c *DiskspaceCollector) Report() (structs.MetricSlice, error) {
 	var report structs.MetricSlice
-	data, _ := c.collect()
+	data, err := c.collect()
 
 	if data != nil {
 		units := map[string]string{
@@ -69,14 +75,13 @@ func (c *DiskspaceCollector) Report() (structs.MetricSlice, error) {
 		}
 	}
 
-	return report, nil
+	return report, err
 }
 
 func (c *DiskspaceCollector) collect() (map[string]mappings.MetricMap, error) {
 	stat, err := linux.ReadMounts("/proc/mounts")
 	if err != nil {
-		logrus.Fatal("stat read fail")
-		return nil, err
+		return nil, fmt.Errorf("stat read fail: %v", err)
 	}
 
 	var statfsT syscall.Statfs_t
@@ -121,7 +126,7 @@ func (c *DiskspaceCollector) collect() (map[string]mappings.MetricMap, error) {
 func (c *DiskspaceCollector) setFilesystems(conf ini.File) {
 	c.filesystems = map[string]bool{}
 
-	fs, ok := conf.Get("DiskspaceCollector", "filesystems")
+	fs, ok := conf.Get(c.section, "filesystems")
 	if ok {
 		enabledFilesystems := strings.Split(fs, ",")
 		for _, enabledFilesystem := range enabledFilesystems {
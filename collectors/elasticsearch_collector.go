@@ -19,6 +19,13 @@ import "github.com/vaughan0/go-ini"
 type ElasticsearchCollector struct {
 	enabled   bool
 	instances []string
+	section   string
+}
+
+func init() {
+	Register("ElasticsearchCollector", func(section string) CollectorInterface {
+		return &ElasticsearchCollector{section: section}
+	})
 }
 
 // Enabled allows checking whether the collector is enabled or not
@@ -34,7 +41,7 @@ func (c *ElasticsearchCollector) State(state bool) {
 // Setup configures the collector
 func (c *ElasticsearchCollector) Setup(conf ini.File) {
 	c.State(true)
-	instances, ok := conf.Get("ElasticsearchCollector", "instances")
+	instances, ok := conf.Get(c.section, "instances")
 	if !ok {
 		instances = "http://127.0.0.1:9200"
 	}
@@ -5,13 +5,18 @@ import "regexp"
 import "github.com/c9s/goprocinfo/linux"
 import "github.com/mike-a-davis/metricsd/mappings"
 import "github.com/mike-a-davis/metricsd/structs"
-import "github.com/Sirupsen/logrus"
 import "github.com/vaughan0/go-ini"
 
 type IostatCollector struct {
 	enabled bool
 }
 
+func init() {
+	Register("IostatCollector", func(_ string) CollectorInterface {
+		return &IostatCollector{}
+	})
+}
+
 func (c *IostatCollector) Enabled() bool {
 	return c.enabled
 }
@@ -26,7 +31,7 @@ func (c *IostatCollector) Setup(conf ini.File) {
 
 func (c *IostatCollector) Report() (structs.MetricSlice, error) {
 	var report structs.MetricSlice
-	data, _ := c.collect()
+	data, err := c.collect()
 
 	if data != nil {
 		for device, values := range data {
@@ -43,14 +48,13 @@ func (c *IostatCollector) Report() (structs.MetricSlice, error) {
 		}
 	}
 
-	return report, nil
+	return report, err
 }
 
 func (c *IostatCollector) collect() (map[string]mappings.MetricMap, error) {
 	stat, err := linux.ReadDiskStats("/proc/diskstats")
 	if err != nil {
-		logrus.Fatal("stat read fail")
-		return nil, err
+		return nil, fmt.Errorf("stat read fail: %v", err)
 	}
 
 	diskusageMapping := map[string]mappings.MetricMap{}
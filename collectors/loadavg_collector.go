@@ -1,15 +1,21 @@
 package collectors
 
+import "fmt"
 import "github.com/c9s/goprocinfo/linux"
 import "github.com/mike-a-davis/metricsd/mappings"
 import "github.com/mike-a-davis/metricsd/structs"
-import "github.com/Sirupsen/logrus"
 import "github.com/vaughan0/go-ini"
 
 type LoadAvgCollector struct {
 	enabled bool
 }
 
+func init() {
+	Register("LoadAvgCollector", func(_ string) CollectorInterface {
+		return &LoadAvgCollector{}
+	})
+}
+
 func (c *LoadAvgCollector) Enabled() bool {
 	return c.enabled
 }
@@ -24,7 +30,7 @@ func (c *LoadAvgCollector) Setup(conf ini.File) {
 
 func (c *LoadAvgCollector) Report() (structs.MetricSlice, error) {
 	var report structs.MetricSlice
-	values, _ := c.collect()
+	values, err := c.collect()
 
 	if values != nil {
 		for k, v := range values {
@@ -37,14 +43,13 @@ func (c *LoadAvgCollector) Report() (structs.MetricSlice, error) {
 		}
 	}
 
-	return report, nil
+	return report, err
 }
 
 func (c *LoadAvgCollector) collect() (mappings.MetricMap, error) {
 	stat, err := linux.ReadLoadAvg("/proc/loadavg")
 	if err != nil {
-		logrus.Fatal("stat read fail")
-		return nil, err
+		return nil, fmt.Errorf("stat read fail: %v", err)
 	}
 
 	// TODO: Add processes_running and processes_total,
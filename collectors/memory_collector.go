@@ -1,15 +1,21 @@
 package collectors
 
+import "fmt"
 import "github.com/c9s/goprocinfo/linux"
 import "github.com/mike-a-davis/metricsd/mappings"
 import "github.com/mike-a-davis/metricsd/structs"
-import "github.com/Sirupsen/logrus"
 import "github.com/vaughan0/go-ini"
 
 type MemoryCollector struct {
 	enabled bool
 }
 
+func init() {
+	Register("MemoryCollector", func(_ string) CollectorInterface {
+		return &MemoryCollector{}
+	})
+}
+
 func (c *MemoryCollector) Enabled() bool {
 	return c.enabled
 }
@@ -24,7 +30,7 @@ func (c *MemoryCollector) Setup(conf ini.File) {
 
 func (c *MemoryCollector) Report() (structs.MetricSlice, error) {
 	var report structs.MetricSlice
-	values, _ := c.collect()
+	values, err := c.collect()
 
 	if values != nil {
 		for k, v := range values {
@@ -38,14 +44,13 @@ func (c *MemoryCollector) Report() (structs.MetricSlice, error) {
 		}
 	}
 
-	return report, nil
+	return report, err
 }
 
 func (c *MemoryCollector) collect() (mappings.MetricMap, error) {
 	stat, err := linux.ReadMemInfo("/proc/meminfo")
 	if err != nil {
-		logrus.Fatal("stat read fail")
-		return nil, err
+		return nil, fmt.Errorf("stat read fail: %v", err)
 	}
 
 	return mappings.MetricMap{
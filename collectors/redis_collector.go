@@ -15,6 +15,13 @@ import (
 type RedisCollector struct {
 	enabled bool
 	url     string
+	section string
+}
+
+func init() {
+	Register("RedisCollector", func(section string) CollectorInterface {
+		return &RedisCollector{section: section}
+	})
 }
 
 func (c *RedisCollector) Enabled() bool {
@@ -28,7 +35,7 @@ func (c *RedisCollector) State(state bool) {
 func (c *RedisCollector) Setup(conf ini.File) {
 	c.State(true)
 
-	useRedisURL, ok := conf.Get("RedisCollector", "url")
+	useRedisURL, ok := conf.Get(c.section, "url")
 	if ok {
 		c.url = useRedisURL
 	} else {
@@ -0,0 +1,44 @@
+package collectors
+
+import "fmt"
+import "sync"
+
+// Factory is an exported type that builds a new,
+// unconfigured collector for the given config section
+type Factory func(section string) CollectorInterface
+
+var registry = make(map[string]Factory)
+var registryMu sync.RWMutex
+
+// Register makes a collector available under name. It is meant to be
+// called from init and panics if the name is already taken.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("collector %s registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// Registered allows checking whether a collector exists under name
+func Registered(name string) bool {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	_, ok := registry[name]
+	return ok
+}
+
+// New builds the collector registered under name for a config section
+func New(name string, section string) (CollectorInterface, error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown collector %s", name)
+	}
+	return factory(section), nil
+}
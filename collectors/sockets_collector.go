@@ -1,16 +1,22 @@
 package collectors
 
+import "fmt"
 import "strings"
 import "github.com/c9s/goprocinfo/linux"
 import "github.com/mike-a-davis/metricsd/mappings"
 import "github.com/mike-a-davis/metricsd/structs"
-import "github.com/Sirupsen/logrus"
 import "github.com/vaughan0/go-ini"
 
 type SocketsCollector struct {
 	enabled bool
 }
 
+func init() {
+	Register("SocketsCollector", func(_ string) CollectorInterface {
+		return &SocketsCollector{}
+	})
+}
+
 func (c *SocketsCollector) Enabled() bool {
 	return c.enabled
 }
@@ -25,7 +31,7 @@ func (c *SocketsCollector) Setup(conf ini.File) {
 
 func (c *SocketsCollector) Report() (structs.MetricSlice, error) {
 	var report structs.MetricSlice
-	values, _ := c.collect()
+	values, err := c.collect()
 
 	if values != nil {
 		for k, v := range values {
@@ -47,14 +53,13 @@ func (c *SocketsCollector) Report() (structs.MetricSlice, error) {
 		}
 	}
 
-	return report, nil
+	return report, err
 }
 
 func (c *SocketsCollector) collect() (mappings.MetricMap, error) {
 	stat, err := linux.ReadSockStat("/proc/net/sockstat")
 	if err != nil {
-		logrus.Fatal("stat read fail")
-		return nil, err
+		return nil, fmt.Errorf("stat read fail: %v", err)
 	}
 
 	return mappings.MetricMap{
@@ -1,15 +1,21 @@
 package collectors
 
+import "fmt"
 import "github.com/c9s/goprocinfo/linux"
 import "github.com/mike-a-davis/metricsd/mappings"
 import "github.com/mike-a-davis/metricsd/structs"
-import "github.com/Sirupsen/logrus"
 import "github.com/vaughan0/go-ini"
 
 type VmstatCollector struct {
 	enabled bool
 }
 
+func init() {
+	Register("VmstatCollector", func(_ string) CollectorInterface {
+		return &VmstatCollector{}
+	})
+}
+
 func (c *VmstatCollector) Enabled() bool {
 	return c.enabled
 }
@@ -24,7 +30,7 @@ func (c *VmstatCollector) Setup(conf ini.File) {
 
 func (c *VmstatCollector) Report() (structs.MetricSlice, error) {
 	var report structs.MetricSlice
-	values, _ := c.collect()
+	values, err := c.collect()
 
 	if values != nil {
 		for k, v := range values {
@@ -37,14 +43,13 @@ func (c *VmstatCollector) Report() (structs.MetricSlice, error) {
 		}
 	}
 
-	return report, nil
+	return report, err
 }
 
 func (c *VmstatCollector) collect() (mappings.MetricMap, error) {
 	stat, err := linux.ReadVMStat("/proc/vmstat")
 	if err != nil {
-		logrus.Fatal("stat read fail")
-		return nil, err
+		return nil, fmt.Errorf("stat read fail: %v", err)
 	}
 
 	return mappings.MetricMap{
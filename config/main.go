@@ -1,12 +1,34 @@
 package config
 
+import "fmt"
 import "os"
+import "strconv"
+import "strings"
+import "github.com/mike-a-davis/metricsd/structs"
 import "github.com/ogier/pflag"
 import "github.com/Sirupsen/logrus"
 import "github.com/vaughan0/go-ini"
 
+var ConfigFile string
 var LogLevel string
 
+// keys that must hold a positive number of seconds, bytes or items
+var numericKeys = []string{
+	"interval",
+	"timeout",
+	"shutdown_timeout",
+	"batch_size",
+	"flush_interval",
+	"retry_max",
+	"queue_size",
+	"max_age",
+	"spool_max_bytes",
+	"max_length",
+	"max_size",
+	"rotate_interval",
+	"keep",
+}
+
 func Setup() ini.File {
 	configFile := pflag.String("config", "/etc/metricsd/metricsd.ini", "full path to config file.")
 	loglevel := pflag.String("loglevel", "warning", "one of the following loglevels: [debug, info, warning, error, fatal, panic]")
@@ -16,16 +38,58 @@ func Setup() ini.File {
 		logrus.Fatal("config file not specified")
 	}
 
-	if _, err := os.Stat(*configFile); err != nil {
-		logrus.Fatal("config file does not exist")
-	}
-
-	file, err := ini.LoadFile(*configFile)
+	file, err := Load(*configFile)
 	if err != nil {
-		logrus.Fatal("config file read failure")
+		logrus.Fatal(err)
 	}
 
+	ConfigFile = *configFile
 	LogLevel = *loglevel
 
 	return file
 }
+
+// Load reads and validates the config file at path
+func Load(path string) (ini.File, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("config file does not exist")
+	}
+
+	file, err := ini.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file read failure: %v", err)
+	}
+
+	if err := Validate(file); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Validate checks the settings shared by every section
+func Validate(file ini.File) error {
+	for name, section := range file {
+		if enabled, ok := section["enabled"]; ok && enabled != "true" && enabled != "false" {
+			return fmt.Errorf("[%s] enabled must be true or false, got %q", name, enabled)
+		}
+
+		for _, key := range numericKeys {
+			value, ok := section[key]
+			if !ok {
+				continue
+			}
+			if i, err := strconv.Atoi(strings.TrimSpace(value)); err != nil || i < 0 {
+				return fmt.Errorf("[%s] %s must be a non-negative number, got %q", name, key, value)
+			}
+		}
+
+		if template, ok := section["template"]; ok {
+			if _, err := structs.ParseNameTemplate(template); err != nil {
+				return fmt.Errorf("[%s] %v", name, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -1,34 +1,112 @@
 package main
 
 import "fmt"
-import "reflect"
+import "os"
+import "os/signal"
 import "strconv"
 import "strings"
 import "sync"
+import "syscall"
 import "time"
-import "github.com/mike-a-davis/metricsd/collectors"
 import "github.com/mike-a-davis/metricsd/config"
-import "github.com/mike-a-davis/metricsd/shippers"
 import "github.com/mike-a-davis/metricsd/structs"
 import "github.com/Sirupsen/logrus"
 import "github.com/vaughan0/go-ini"
 
 var conf ini.File
+var confMu sync.RWMutex
 
 func main() {
 	conf = config.Setup()
 	initializeLogging()
-	shippers := getShippers()
-	collectorList := getCollectors()
-	interval := getInterval()
 	loop, _ := conf.Get("metricsd", "loop")
 
-	runCollect(shippers, collectorList)
-	if loop == "true" {
-		for _ = range time.Tick(interval) {
-			runCollect(shippers, collectorList)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	c := make(chan *structs.Metric)
+	quit := make(chan struct{})
+	var reporterWg sync.WaitGroup
+	reporterWg.Add(1)
+
+	s := newScheduler(c, loop == "true")
+	o := newOutlets()
+	apply(s, o, ini.File{}, conf)
+
+	go func() {
+		defer reporterWg.Done()
+		report(c, o, quit)
+	}()
+
+	// a looping scheduler never finishes on its own,
+	// and a nil channel keeps the select below waiting
+	var finished chan struct{}
+	if loop != "true" {
+		finished = s.done()
+	}
+
+	for running := true; running; {
+		select {
+		case <-finished:
+			running = false
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				reload(s, o)
+				continue
+			}
+
+			logrus.Info(fmt.Sprintf("received %s, shutting down", sig))
+			s.stop()
+			running = false
 		}
 	}
+
+	os.Exit(shutdown(s, o, quit, &reporterWg))
+}
+
+func currentConf() ini.File {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	return conf
+}
+
+func setConf(file ini.File) {
+	confMu.Lock()
+	defer confMu.Unlock()
+	conf = file
+}
+
+// shutdown waits for running collectors, flushes the last batch and
+// closes every shipper, all within the shutdown timeout. It returns
+// the exit status for the process.
+func shutdown(s *scheduler, o *outlets, quit chan struct{}, reporterWg *sync.WaitGroup) int {
+	status := 0
+	deadline := time.Now().Add(getShutdownTimeout())
+
+	if !s.wait(deadline) {
+		logrus.Warning("collectors did not finish before the shutdown timeout")
+		status = 1
+	}
+
+	// the reporter may be waiting on a full queue, which
+	// must not hold up shutdown past the deadline
+	for _, shipper := range o.list() {
+		shipper.SetDeadline(deadline)
+	}
+
+	close(quit)
+	reporterWg.Wait()
+
+	for _, shipper := range o.list() {
+		if !shipper.Close(deadline) {
+			status = 1
+		}
+	}
+
+	if status != 0 {
+		logrus.Warning("metrics may have been lost during shutdown")
+	}
+	return status
 }
 
 func getInterval() time.Duration {
@@ -36,48 +114,57 @@ func getInterval() time.Duration {
 	interval, ok := conf.Get("metricsd", "interval")
 
 	if ok {
-		interval, err := strconv.Atoi(interval)
-		if err == nil {
-			return time.Duration(interval) * time.Second
+		if interval, ok := parseSeconds(interval); ok {
+			return interval
 		}
 	}
 	return time.Duration(defaultInterval) * time.Second
 }
 
-func runCollect(shippers []shippers.ShipperInterface, collectorList []collectors.CollectorInterface) {
-	c := make(chan *structs.Metric)
-	var collectorWg sync.WaitGroup
-	var reporterWg sync.WaitGroup
-	var active = 0
-
-	for _, collector := range collectorList {
-		if collector.Enabled() {
-			active++
+func getShutdownTimeout() time.Duration {
+	if timeout, ok := conf.Get("metricsd", "shutdown_timeout"); ok {
+		if timeout, ok := parseSeconds(timeout); ok {
+			return timeout
 		}
+		logrus.Warning("invalid shutdown_timeout, using default")
 	}
+	return 10 * time.Second
+}
 
-	collectorWg.Add(active)
-	reporterWg.Add(1)
+func getCollectorInterval(name string) time.Duration {
+	interval, ok := conf.Get(name, "interval")
 
-	for _, collector := range collectorList {
-		if !collector.Enabled() {
-			continue
+	if ok {
+		if interval, ok := parseSeconds(interval); ok {
+			return interval
 		}
+		logrus.Warning(fmt.Sprintf("invalid interval for %s, using global interval", name))
+	}
+	return getInterval()
+}
 
-		go func(collector collectors.CollectorInterface) {
-			defer collectorWg.Done()
-			collect(c, collector)
-		}(collector)
+func getCollectorTimeout(name string, interval time.Duration) time.Duration {
+	if timeout, ok := conf.Get(name, "timeout"); ok {
+		if timeout, ok := parseSeconds(timeout); ok {
+			return timeout
+		}
+		logrus.Warning(fmt.Sprintf("invalid timeout for %s, ignoring", name))
 	}
 
-	go func() {
-		defer reporterWg.Done()
-		report(c, shippers)
-	}()
+	if timeout, ok := conf.Get("metricsd", "timeout"); ok {
+		if timeout, ok := parseSeconds(timeout); ok {
+			return timeout
+		}
+	}
+	return interval
+}
 
-	collectorWg.Wait()
-	close(c)
-	reporterWg.Wait()
+func parseSeconds(value string) (time.Duration, bool) {
+	seconds, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || seconds <= 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
 }
 
 func initializeLogging() {
@@ -98,98 +185,18 @@ func initializeLogging() {
 	}
 }
 
-func collect(c chan *structs.Metric, collector collectors.CollectorInterface) {
-	data, err := collector.Report()
-	if err != nil {
-		close(c)
-		return
-	}
-
-	for _, element := range data {
-		c <- element
-	}
-}
-
-func report(c chan *structs.Metric, shippers []shippers.ShipperInterface) {
-	var list structs.MetricSlice
-
-	for item := range c {
-		item.Process(conf)
-		list = append(list, item)
-
-		if len(list) == 10 {
-			logrus.Debug(fmt.Sprintf("shipping %d messages", len(list)))
-			for _, shipper := range shippers {
+func report(c chan *structs.Metric, o *outlets, quit chan struct{}) {
+	for {
+		select {
+		case item := <-c:
+			item.Process(currentConf())
+			for _, shipper := range o.list() {
 				if shipper.Enabled() {
-					shipper.Ship(list)
+					shipper.Add(item)
 				}
 			}
-			list = nil
+		case <-quit:
+			return
 		}
 	}
-
-	if len(list) > 0 {
-		logrus.Debug(fmt.Sprintf("shipping %d messages", len(list)))
-		for _, shipper := range shippers {
-			if shipper.Enabled() {
-				shipper.Ship(list)
-			}
-		}
-		list = nil
-	}
-}
-
-func getShippers() []shippers.ShipperInterface {
-	var shipperList []shippers.ShipperInterface
-	var enabled string
-
-	shipperList = append(shipperList, &shippers.GraphiteShipper{})
-	shipperList = append(shipperList, &shippers.LogstashElasticsearchShipper{})
-	shipperList = append(shipperList, &shippers.StdoutShipper{})
-	shipperList = append(shipperList, &shippers.LogstashRedisShipper{})
-	shipperList = append(shipperList, &shippers.MlxShipper{})
-
-	for _, shipper := range shipperList {
-		collectorName := strings.Split(reflect.TypeOf(shipper).String(), ".")[1]
-		enabled, _ = conf.Get(collectorName, "enabled")
-		if enabled == "true" {
-			logrus.Debug(fmt.Sprintf("enabling %s", collectorName))
-			shipper.Setup(conf)
-			shipper.State(true)
-		} else {
-			shipper.State(false)
-		}
-	}
-
-	return shipperList
-}
-
-func getCollectors() []collectors.CollectorInterface {
-	var collectorList []collectors.CollectorInterface
-	var enabled string
-
-	// iostat: (diskstat.go + mangling) /proc/diskstats
-	collectorList = append(collectorList, &collectors.CpuCollector{})
-	collectorList = append(collectorList, &collectors.DiskspaceCollector{})
-	collectorList = append(collectorList, &collectors.ElasticsearchCollector{})
-	collectorList = append(collectorList, &collectors.IostatCollector{})
-	collectorList = append(collectorList, &collectors.LoadAvgCollector{})
-	collectorList = append(collectorList, &collectors.MemoryCollector{})
-	collectorList = append(collectorList, &collectors.RedisCollector{})
-	collectorList = append(collectorList, &collectors.SocketsCollector{})
-	collectorList = append(collectorList, &collectors.VmstatCollector{})
-
-	for _, collector := range collectorList {
-		collectorName := strings.Split(reflect.TypeOf(collector).String(), ".")[1]
-		enabled, _ = conf.Get(collectorName, "enabled")
-		if enabled == "true" {
-			logrus.Debug(fmt.Sprintf("enabling %s", collectorName))
-			collector.Setup(conf)
-			collector.State(true)
-		} else {
-			collector.State(false)
-		}
-	}
-
-	return collectorList
 }
@@ -0,0 +1,206 @@
+package main
+
+import "fmt"
+import "reflect"
+import "strings"
+import "sync"
+import "time"
+import "github.com/mike-a-davis/metricsd/collectors"
+import "github.com/mike-a-davis/metricsd/config"
+import "github.com/mike-a-davis/metricsd/shippers"
+import "github.com/mike-a-davis/metricsd/stats"
+import "github.com/Sirupsen/logrus"
+import "github.com/vaughan0/go-ini"
+
+// outlets holds the shippers the report pipeline fans out
+// to, which can be swapped while the pipeline is running
+type outlets struct {
+	shippers map[string]*shippers.Delivery
+	mu       sync.RWMutex
+}
+
+func newOutlets() *outlets {
+	return &outlets{shippers: make(map[string]*shippers.Delivery)}
+}
+
+func (o *outlets) list() []*shippers.Delivery {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	var list []*shippers.Delivery
+	for _, shipper := range o.shippers {
+		list = append(list, shipper)
+	}
+	return list
+}
+
+func (o *outlets) names() []string {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	var names []string
+	for name := range o.shippers {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (o *outlets) get(name string) *shippers.Delivery {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.shippers[name]
+}
+
+func (o *outlets) add(name string, shipper *shippers.Delivery) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.shippers[name] = shipper
+}
+
+func (o *outlets) remove(name string) *shippers.Delivery {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	shipper := o.shippers[name]
+	delete(o.shippers, name)
+	return shipper
+}
+
+// reload re-reads the config file on SIGHUP. An invalid
+// config is logged and the running one is kept as it is.
+func reload(s *scheduler, o *outlets) {
+	newConf, err := config.Load(config.ConfigFile)
+	if err != nil {
+		logrus.Error(fmt.Sprintf("reloading config failed, keeping the current one: %s", err))
+		return
+	}
+
+	logrus.Info(fmt.Sprintf("reloading config from %s", config.ConfigFile))
+	oldConf := conf
+	setConf(newConf)
+	apply(s, o, oldConf, newConf)
+}
+
+// apply brings the running collectors and shippers in line with
+// newConf. Components whose settings are the same in oldConf are
+// left running untouched.
+func apply(s *scheduler, o *outlets, oldConf ini.File, newConf ini.File) {
+	for _, name := range s.names() {
+		if !isEnabled(newConf, name) || !collectors.Registered(pluginName(newConf, name)) {
+			s.remove(name)
+			stats.Forget(name)
+			logrus.Info(fmt.Sprintf("disabling %s", name))
+		}
+	}
+
+	deadline := time.Now().Add(getShutdownTimeout())
+	for _, name := range o.names() {
+		if !isEnabled(newConf, name) || !shippers.Registered(pluginName(newConf, name)) {
+			logrus.Info(fmt.Sprintf("disabling %s", name))
+			o.remove(name).Close(deadline)
+			stats.Forget(name)
+		}
+	}
+
+	for name := range newConf {
+		if name == "metricsd" || !isEnabled(newConf, name) {
+			continue
+		}
+
+		plugin := pluginName(newConf, name)
+		switch {
+		case collectors.Registered(plugin):
+			applyCollector(s, oldConf, newConf, name, plugin)
+		case shippers.Registered(plugin):
+			applyShipper(o, oldConf, newConf, name, plugin, deadline)
+		default:
+			logrus.Warning(fmt.Sprintf("%s: unknown collector or shipper %s", name, plugin))
+		}
+	}
+}
+
+func applyCollector(s *scheduler, oldConf ini.File, newConf ini.File, name string, plugin string) {
+	interval := getCollectorInterval(name)
+	timeout := getCollectorTimeout(name, interval)
+	if j := s.get(name); j != nil && sectionEqual(oldConf, newConf, name) && j.interval == interval && j.timeout == timeout {
+		return
+	}
+
+	collector, err := collectors.New(plugin, name)
+	if err != nil {
+		logrus.Warning(err)
+		return
+	}
+
+	logrus.Debug(fmt.Sprintf("enabling %s every %s with a %s timeout", name, interval, timeout))
+	collector.Setup(newConf)
+	collector.State(true)
+	s.add(name, instanceName(newConf, name), collector, interval, timeout)
+}
+
+func applyShipper(o *outlets, oldConf ini.File, newConf ini.File, name string, plugin string, deadline time.Time) {
+	if o.get(name) != nil && sectionEqual(oldConf, newConf, name) && globalEqual(oldConf, newConf, shippers.GlobalSettings...) {
+		return
+	}
+
+	shipper, err := shippers.New(plugin, name)
+	if err != nil {
+		logrus.Warning(err)
+		return
+	}
+
+	if old := o.remove(name); old != nil {
+		old.Close(deadline)
+	}
+
+	logrus.Debug(fmt.Sprintf("enabling %s", name))
+	delivery := shippers.NewDelivery(name, shipper)
+	delivery.Setup(newConf)
+	delivery.State(true)
+	o.add(name, delivery)
+}
+
+// pluginName returns the collector or shipper a section configures.
+// It is set with the plugin key, or else taken from the section name,
+// where anything after a colon names the instance.
+func pluginName(file ini.File, name string) string {
+	if plugin, ok := file.Get(name, "plugin"); ok {
+		return plugin
+	}
+	return strings.SplitN(name, ":", 2)[0]
+}
+
+// instanceName returns the name that sets a section apart from
+// others configuring the same plugin, or an empty string if the
+// section is simply named after its plugin
+func instanceName(file ini.File, name string) string {
+	if parts := strings.SplitN(name, ":", 2); len(parts) == 2 {
+		return parts[1]
+	}
+	if pluginName(file, name) != name {
+		return name
+	}
+	return ""
+}
+
+func isEnabled(file ini.File, name string) bool {
+	enabled, _ := file.Get(name, "enabled")
+	return enabled == "true"
+}
+
+// globalEqual checks whether the [metricsd] settings that
+// components fall back on are the same in both files
+func globalEqual(a ini.File, b ini.File, keys ...string) bool {
+	for _, key := range keys {
+		valueA, okA := a.Get("metricsd", key)
+		valueB, okB := b.Get("metricsd", key)
+		if valueA != valueB || okA != okB {
+			return false
+		}
+	}
+	return true
+}
+
+func sectionEqual(a ini.File, b ini.File, name string) bool {
+	return reflect.DeepEqual(a[name], b[name])
+}
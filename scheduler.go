@@ -0,0 +1,150 @@
+package main
+
+import "sync"
+import "time"
+import "github.com/mike-a-davis/metricsd/collectors"
+import "github.com/mike-a-davis/metricsd/structs"
+
+// scheduler runs every collector on its own interval
+// and feeds the results into the shared report channel
+type scheduler struct {
+	c    chan *structs.Metric
+	loop bool
+	jobs map[string]*job
+	mu   sync.Mutex
+	wg   sync.WaitGroup
+}
+
+type job struct {
+	name      string
+	instance  string
+	collector collectors.CollectorInterface
+	interval  time.Duration
+	timeout   time.Duration
+	running   int32
+	stop      chan struct{}
+}
+
+func newScheduler(c chan *structs.Metric, loop bool) *scheduler {
+	return &scheduler{
+		c:    c,
+		loop: loop,
+		jobs: make(map[string]*job),
+	}
+}
+
+// add starts running a collector at the given interval, with each run
+// bounded by timeout. Metrics of a named instance are tagged with it.
+// An already scheduled collector of the same name is replaced without
+// touching any of the other jobs.
+func (s *scheduler) add(name string, instance string, collector collectors.CollectorInterface, interval time.Duration, timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.jobs[name]; ok {
+		close(existing.stop)
+	}
+
+	j := &job{
+		name:      name,
+		instance:  instance,
+		collector: collector,
+		interval:  interval,
+		timeout:   timeout,
+		stop:      make(chan struct{}),
+	}
+	s.jobs[name] = j
+
+	s.wg.Add(1)
+	go s.run(j)
+}
+
+// get returns the job scheduled under name, if any
+func (s *scheduler) get(name string) *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobs[name]
+}
+
+// names returns the names of all scheduled jobs
+func (s *scheduler) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for name := range s.jobs {
+		names = append(names, name)
+	}
+	return names
+}
+
+// remove stops scheduling a collector, returning false
+// if there was nothing scheduled under that name
+func (s *scheduler) remove(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[name]
+	if ok {
+		close(j.stop)
+		delete(s.jobs, name)
+	}
+	return ok
+}
+
+// stop prevents any further runs from being started
+func (s *scheduler) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, j := range s.jobs {
+		close(j.stop)
+		delete(s.jobs, name)
+	}
+}
+
+// wait blocks until every job has returned, which only happens on
+// its own when the scheduler is not looping. It returns false if
+// the deadline passed first.
+func (s *scheduler) wait(deadline time.Time) bool {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-s.done():
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// done returns a channel that is closed once every job has returned
+func (s *scheduler) done() chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+func (s *scheduler) run(j *job) {
+	defer s.wg.Done()
+
+	j.collect(s.c)
+	if !s.loop {
+		return
+	}
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+			j.collect(s.c)
+		}
+	}
+}
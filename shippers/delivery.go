@@ -0,0 +1,557 @@
+package shippers
+
+import "fmt"
+import "math/rand"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+import "github.com/mike-a-davis/metricsd/stats"
+import "github.com/mike-a-davis/metricsd/structs"
+import "github.com/Sirupsen/logrus"
+import "github.com/vaughan0/go-ini"
+
+const (
+	defaultBatchSize     = 10
+	defaultFlushInterval = 1
+	defaultRetryMax      = 5
+	defaultQueueSize     = 100
+	defaultOverflow      = "drop_oldest"
+	defaultMaxAge        = 10 * time.Minute
+	defaultSpoolSize     = 100 * 1024 * 1024
+	minBackoff           = 1 * time.Second
+	maxBackoff           = 1 * time.Minute
+)
+
+// GlobalSettings lists the settings a Delivery falls back on
+// in the [metricsd] section when the shipper section lacks them
+var GlobalSettings = []string{"batch_size", "flush_interval"}
+
+// Delivery is an exported type that wraps a shipper with
+// a bounded in-memory queue, retrying failed batches with
+// exponential backoff instead of dropping them
+//
+// Metrics are added one at a time and grouped into batches
+// of the shipper's own size, so every shipper can use the
+// batch size that suits its backend.
+//
+// When a spool is configured, batches that overflow the queue
+// or run out of retries are written to disk and replayed once
+// the shipper succeeds again.
+type Delivery struct {
+	name          string
+	shipper       ShipperInterface
+	batchSize     int
+	flushInterval time.Duration
+	retryMax      int
+	queueSize     int
+	overflow      string
+	maxAge        time.Duration
+	spool         *Spool
+	batch         structs.MetricSlice
+	batchMu       sync.Mutex
+	queue         []*pendingBatch
+	closed        bool
+	deadline      time.Time
+	mu            sync.Mutex
+	space         *sync.Cond
+	wake          chan struct{}
+	stop          chan struct{}
+	done          chan struct{}
+}
+
+type pendingBatch struct {
+	logs     structs.MetricSlice
+	created  time.Time
+	attempts int
+}
+
+// NewDelivery wraps a shipper configured by the given section
+func NewDelivery(name string, shipper ShipperInterface) *Delivery {
+	d := &Delivery{
+		name:    name,
+		shipper: shipper,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	d.space = sync.NewCond(&d.mu)
+	return d
+}
+
+// Enabled allows checking whether the wrapped shipper is enabled or not
+func (d *Delivery) Enabled() bool {
+	return d.shipper.Enabled()
+}
+
+// State allows setting the enabled state of the wrapped shipper
+func (d *Delivery) State(state bool) {
+	d.shipper.State(state)
+}
+
+// Setup configures the wrapped shipper and starts delivering batches
+func (d *Delivery) Setup(conf ini.File) {
+	d.shipper.Setup(conf)
+
+	d.batchSize = getGlobalInt(conf, d.name, "batch_size", defaultBatchSize)
+	d.flushInterval = time.Duration(getGlobalInt(conf, d.name, "flush_interval", defaultFlushInterval)) * time.Second
+	if d.batchSize < 1 {
+		d.batchSize = 1
+	}
+	if d.flushInterval <= 0 {
+		d.flushInterval = defaultFlushInterval * time.Second
+	}
+
+	d.retryMax = getInt(conf, d.name, "retry_max", defaultRetryMax)
+	d.queueSize = getInt(conf, d.name, "queue_size", defaultQueueSize)
+	d.maxAge = time.Duration(getInt(conf, d.name, "max_age", int(defaultMaxAge/time.Second))) * time.Second
+	if d.queueSize < 1 {
+		d.queueSize = 1
+	}
+
+	d.overflow = defaultOverflow
+	if overflow, ok := conf.Get(d.name, "overflow"); ok {
+		switch overflow {
+		case "block", "drop_oldest", "drop_newest":
+			d.overflow = overflow
+		default:
+			logrus.Warning(fmt.Sprintf("invalid overflow for %s, using %s", d.name, defaultOverflow))
+		}
+	}
+
+	if dir, ok := conf.Get(d.name, "spool_dir"); ok {
+		maxBytes := getInt(conf, d.name, "spool_max_bytes", defaultSpoolSize)
+		spool, err := OpenSpool(dir, int64(maxBytes))
+		if err != nil {
+			logrus.Warning(fmt.Sprintf("%s spool disabled: %s", d.name, err))
+		} else {
+			d.spool = spool
+		}
+	}
+
+	go d.run()
+	go d.flusher()
+}
+
+// Add appends a metric to the batch being built, queueing
+// the batch for delivery once it holds batch_size metrics.
+// Metrics added once the delivery is closed are discarded.
+func (d *Delivery) Add(item *structs.Metric) {
+	var full structs.MetricSlice
+
+	d.batchMu.Lock()
+	d.mu.Lock()
+	closed := d.closed
+	d.mu.Unlock()
+	if closed {
+		d.batchMu.Unlock()
+		d.discard(&pendingBatch{logs: structs.MetricSlice{item}, created: time.Now()}, "shipper closed")
+		return
+	}
+	d.batch = append(d.batch, item)
+	if len(d.batch) >= d.batchSize {
+		full = d.batch
+		d.batch = nil
+	}
+	d.batchMu.Unlock()
+
+	if full != nil {
+		d.Ship(full)
+	}
+}
+
+// Flush queues the batch being built for delivery, however small
+func (d *Delivery) Flush() {
+	d.batchMu.Lock()
+	batch := d.batch
+	d.batch = nil
+	d.batchMu.Unlock()
+
+	if len(batch) > 0 {
+		d.Ship(batch)
+	}
+}
+
+// Ship queues a list of MetricSlices for delivery. What happens when
+// the queue is full depends on the overflow policy: block waits for
+// room, while drop_oldest and drop_newest spool or drop a batch.
+func (d *Delivery) Ship(logs structs.MetricSlice) error {
+	batch := &pendingBatch{logs: logs, created: time.Now()}
+	var discarded []*pendingBatch
+
+	d.mu.Lock()
+	if d.overflow == "block" {
+		for len(d.queue) >= d.queueSize && !d.closed && !d.expired() {
+			d.space.Wait()
+		}
+	}
+
+	// a blocking queue that is still full has passed its
+	// deadline, and then drops the newest batch as well
+	switch {
+	case d.closed:
+		discarded = append(discarded, batch)
+	case d.overflow != "drop_oldest" && len(d.queue) >= d.queueSize:
+		discarded = append(discarded, batch)
+	default:
+		d.queue = append(d.queue, batch)
+		for len(d.queue) > d.queueSize {
+			discarded = append(discarded, d.queue[0])
+			d.queue = d.queue[1:]
+		}
+	}
+	closed := d.closed
+	d.recordQueue()
+	d.mu.Unlock()
+
+	for _, batch := range discarded {
+		if closed {
+			d.discard(batch, "shipper closed")
+		} else {
+			d.discard(batch, "queue full")
+		}
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetDeadline bounds how long Ship waits for room in the queue
+// under the block policy. Once the deadline passes, batches that
+// don't fit are spooled or dropped as with drop_newest.
+func (d *Delivery) SetDeadline(deadline time.Time) {
+	d.mu.Lock()
+	d.deadline = deadline
+	d.mu.Unlock()
+
+	time.AfterFunc(time.Until(deadline), func() {
+		d.mu.Lock()
+		d.space.Broadcast()
+		d.mu.Unlock()
+	})
+}
+
+// Drain waits until every queued batch has been delivered or
+// dropped, returning false if the deadline passed first
+func (d *Delivery) Drain(deadline time.Time) bool {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for d.head() != nil {
+		if time.Now().After(deadline) {
+			return false
+		}
+		<-ticker.C
+	}
+	return true
+}
+
+// Close delivers what is left in the queue until the deadline, spools
+// or drops whatever is still pending and closes the wrapped shipper.
+// It returns false if anything could not be delivered in time.
+func (d *Delivery) Close(deadline time.Time) bool {
+	d.SetDeadline(deadline)
+	d.Flush()
+	delivered := d.Drain(deadline)
+	close(d.stop)
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-d.done:
+	case <-timer.C:
+		logrus.Warning(fmt.Sprintf("%s still shipping at shutdown deadline", d.name))
+		delivered = false
+	}
+
+	d.mu.Lock()
+	leftover := d.queue
+	d.queue = nil
+	d.closed = true
+	d.recordQueue()
+	d.space.Broadcast()
+	d.mu.Unlock()
+
+	// Add checks closed while holding batchMu, so anything added
+	// since the flush above is in the batch by now
+	d.batchMu.Lock()
+	if len(d.batch) > 0 {
+		leftover = append(leftover, &pendingBatch{logs: d.batch, created: time.Now()})
+		d.batch = nil
+	}
+	d.batchMu.Unlock()
+
+	for _, batch := range leftover {
+		d.discard(batch, "shutting down")
+	}
+
+	if d.spool != nil {
+		if err := d.spool.Close(); err != nil {
+			logrus.Warning(fmt.Sprintf("%s closing spool failed: %s", d.name, err))
+		}
+	}
+
+	// the shipper is closed even when it is still shipping past
+	// the deadline, so that a listener it holds is released for
+	// the shipper replacing it on reload. Shippers that lock in
+	// Close wait for the batch in flight, bounded by their timeout.
+	if closer, ok := d.shipper.(Closer); ok {
+		if err := closer.Close(); err != nil {
+			logrus.Warning(fmt.Sprintf("%s closing failed: %s", d.name, err))
+			delivered = false
+		}
+	}
+
+	return delivered
+}
+
+func (d *Delivery) run() {
+	defer close(d.done)
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+
+		batch := d.head()
+		if batch == nil {
+			select {
+			case <-d.wake:
+				continue
+			case <-d.stop:
+				return
+			}
+		}
+
+		if d.maxAge > 0 && time.Since(batch.created) > d.maxAge {
+			logrus.Warning(fmt.Sprintf("%s dropping %d messages older than %s", d.name, len(batch.logs), d.maxAge))
+			stats.RecordDrop(d.name, len(batch.logs))
+			d.remove(batch)
+			continue
+		}
+
+		err := d.ship(batch.logs)
+		if err == nil {
+			d.remove(batch)
+			d.replay()
+			continue
+		}
+		if partial, ok := err.(*PartialError); ok {
+			d.mu.Lock()
+			batch.logs = partial.Remaining
+			d.mu.Unlock()
+		}
+		if d.rejected(batch.logs, err) {
+			d.remove(batch)
+			continue
+		}
+
+		batch.attempts++
+		if batch.attempts > d.retryMax {
+			d.remove(batch)
+			d.discard(batch, fmt.Sprintf("failed after %d attempts: %s", batch.attempts, err))
+			continue
+		}
+
+		wait := backoff(batch.attempts)
+		logrus.Info(fmt.Sprintf("%s shipping failed, retrying in %s: %s", d.name, wait, err))
+		select {
+		case <-time.After(wait):
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// flusher ships partial batches every flush_interval, so
+// metrics never wait long for a batch to fill up
+func (d *Delivery) flusher() {
+	ticker := time.NewTicker(d.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.Flush()
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// discard spools a batch that can't stay in memory, or drops it
+// when there is no spool or writing to it fails
+func (d *Delivery) discard(batch *pendingBatch, reason string) {
+	if d.spool != nil {
+		err := d.spool.Write(batch.logs)
+		if err == nil {
+			logrus.Info(fmt.Sprintf("%s spooled %d messages: %s", d.name, len(batch.logs), reason))
+			stats.RecordSpool(d.name, len(batch.logs))
+			return
+		}
+		logrus.Warning(fmt.Sprintf("%s spooling failed: %s", d.name, err))
+	}
+
+	logrus.Warning(fmt.Sprintf("%s dropping %d messages: %s", d.name, len(batch.logs), reason))
+	stats.RecordDrop(d.name, len(batch.logs))
+}
+
+// replay ships whatever was spooled while the shipper was failing
+func (d *Delivery) replay() {
+	if d.spool == nil || d.spool.Empty() {
+		return
+	}
+
+	logrus.Info(fmt.Sprintf("%s replaying spooled messages", d.name))
+	replay := func(logs structs.MetricSlice) error {
+		err := d.ship(logs)
+		if d.rejected(logs, err) {
+			return nil
+		}
+		// the rest of a partly delivered batch goes back into
+		// a new segment, rather than the whole batch being kept
+		if partial, ok := err.(*PartialError); ok {
+			d.discard(&pendingBatch{logs: partial.Remaining, created: time.Now()}, err.Error())
+			return nil
+		}
+		return err
+	}
+	if err := d.spool.Replay(replay); err != nil {
+		logrus.Info(fmt.Sprintf("%s replaying spool stopped: %s", d.name, err))
+	}
+}
+
+// ship calls the wrapped shipper, turning a panic into an error
+func (d *Delivery) ship(logs structs.MetricSlice) (err error) {
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+		stats.RecordShip(d.name, time.Since(start), err)
+	}()
+	return d.shipper.Ship(logs)
+}
+
+// rejected drops a batch the shipper failed with a permanent
+// error, returning false for any other error
+func (d *Delivery) rejected(logs structs.MetricSlice, err error) bool {
+	if _, ok := err.(*PermanentError); !ok {
+		return false
+	}
+
+	logrus.Warning(fmt.Sprintf("%s dropping %d messages: %s", d.name, len(logs), err))
+	stats.RecordDrop(d.name, len(logs))
+	return true
+}
+
+func (d *Delivery) head() *pendingBatch {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.queue) == 0 {
+		return nil
+	}
+	return d.queue[0]
+}
+
+// remove drops a batch from the front of the queue, unless it
+// was already evicted to make room while it was being shipped
+func (d *Delivery) remove(batch *pendingBatch) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.queue) > 0 && d.queue[0] == batch {
+		d.queue = d.queue[1:]
+		d.space.Signal()
+	}
+	d.recordQueue()
+}
+
+// expired reports whether the deadline set by SetDeadline
+// has passed, and must be called with the queue locked
+func (d *Delivery) expired() bool {
+	return !d.deadline.IsZero() && !time.Now().Before(d.deadline)
+}
+
+// recordQueue records how far the shipper has fallen behind,
+// and must be called with the queue locked
+func (d *Delivery) recordQueue() {
+	var oldest time.Time
+	if len(d.queue) > 0 {
+		oldest = d.queue[0].created
+	}
+	stats.RecordQueue(d.name, len(d.queue), oldest)
+}
+
+// backoff doubles the wait for every attempt, capped at maxBackoff,
+// and randomizes the second half so retries don't synchronize
+func backoff(attempt int) time.Duration {
+	wait := maxBackoff
+	if attempt < 16 {
+		if w := minBackoff << uint(attempt-1); w < maxBackoff {
+			wait = w
+		}
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// getGlobalInt reads a setting from the section, falling
+// back to the [metricsd] section and then the default
+func getGlobalInt(conf ini.File, section string, key string, defaultValue int) int {
+	if _, ok := conf.Get(section, key); ok {
+		return getInt(conf, section, key, defaultValue)
+	}
+	return getInt(conf, "metricsd", key, defaultValue)
+}
+
+func getInt(conf ini.File, section string, key string, defaultValue int) int {
+	value, ok := conf.Get(section, key)
+	if !ok {
+		return defaultValue
+	}
+
+	i, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		logrus.Warning(fmt.Sprintf("invalid %s for %s, using %d", key, section, defaultValue))
+		return defaultValue
+	}
+	return i
+}
+
+// getTemplate reads the naming template of the section,
+// returning nil when it is unset or invalid
+func getTemplate(conf ini.File, section string) *structs.NameTemplate {
+	text, ok := conf.Get(section, "template")
+	if !ok {
+		return nil
+	}
+
+	template, err := structs.ParseNameTemplate(text)
+	if err != nil {
+		logrus.Warning(fmt.Sprintf("%s: %s, using the default naming", section, err))
+		return nil
+	}
+	return template
+}
+
+// getLabelSet reads the comma separated exclude_labels of a
+// section, which defaults to leaving out only raw_value
+func getLabelSet(conf ini.File, section string) map[string]bool {
+	text, ok := conf.Get(section, "exclude_labels")
+	if !ok {
+		return map[string]bool{"raw_value": true}
+	}
+
+	labels := map[string]bool{}
+	for _, label := range strings.Split(text, ",") {
+		labels[strings.TrimSpace(label)] = true
+	}
+	return labels
+}
@@ -0,0 +1,314 @@
+package shippers
+
+import "bytes"
+import "compress/gzip"
+import "encoding/csv"
+import "fmt"
+import "io"
+import "os"
+import "os/signal"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "syscall"
+import "time"
+import "github.com/mike-a-davis/metricsd/structs"
+import "github.com/Sirupsen/logrus"
+import "github.com/vaughan0/go-ini"
+
+// FileShipper is an exported type that
+// allows writing metrics to rotated local files
+type FileShipper struct {
+	enabled        bool
+	path           string
+	format         string
+	prefix         string
+	template       *structs.NameTemplate
+	maxSize        int64
+	rotateInterval time.Duration
+	keep           int
+	compress       bool
+	file           *os.File
+	size           int64
+	opened         time.Time
+	reopen         chan os.Signal
+	mu             sync.Mutex
+	section        string
+}
+
+var fileCSVHeader = []string{"timestamp", "host", "from", "path", "name", "type", "value", "data"}
+
+func init() {
+	Register("FileShipper", func(section string) ShipperInterface {
+		return &FileShipper{section: section}
+	})
+}
+
+// Enabled allows checking whether the shipper is enabled or not
+func (s *FileShipper) Enabled() bool {
+	return s.enabled
+}
+
+// State allows setting the enabled state of the shipper
+func (s *FileShipper) State(state bool) {
+	s.enabled = state
+}
+
+// Setup configures the shipper and reopens the file on SIGUSR1
+func (s *FileShipper) Setup(conf ini.File) {
+	s.State(true)
+
+	s.path = "/var/log/metricsd/metrics.log"
+	if path, ok := conf.Get(s.section, "path"); ok {
+		s.path = path
+	}
+
+	s.format = "json"
+	if format, ok := conf.Get(s.section, "format"); ok {
+		if format == "json" || format == "graphite" || format == "csv" {
+			s.format = format
+		} else {
+			logrus.Warning(fmt.Sprintf("%s: invalid format %s, using json", s.section, format))
+		}
+	}
+
+	if prefix, ok := conf.Get(s.section, "prefix"); ok {
+		s.prefix = fmt.Sprintf("%s.", prefix)
+	}
+	s.template = getTemplate(conf, s.section)
+
+	s.maxSize = int64(getInt(conf, s.section, "max_size", 0))
+	s.rotateInterval = time.Duration(getInt(conf, s.section, "rotate_interval", 0)) * time.Second
+	s.keep = getInt(conf, s.section, "keep", 7)
+
+	useCompress, ok := conf.Get(s.section, "compress")
+	s.compress = ok && useCompress == "true"
+
+	s.reopen = make(chan os.Signal, 1)
+	signal.Notify(s.reopen, syscall.SIGUSR1)
+	go s.watch(s.reopen)
+}
+
+// Ship appends a list of MetricSlices to the file, rotating
+// it first whenever it has grown too large or too old
+func (s *FileShipper) Ship(logs structs.MetricSlice) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	for i, item := range logs {
+		line := s.serialize(item)
+		if line == nil {
+			continue
+		}
+
+		// the lines before this one are already written
+		if s.due(int64(len(line))) {
+			if err := s.rotate(); err != nil {
+				return &PartialError{Err: err, Remaining: logs[i:]}
+			}
+		}
+		if s.size == 0 && s.format == "csv" {
+			if err := s.write(s.csvLine(fileCSVHeader)); err != nil {
+				return &PartialError{Err: err, Remaining: logs[i:]}
+			}
+		}
+		if err := s.write(line); err != nil {
+			return &PartialError{Err: err, Remaining: logs[i:]}
+		}
+	}
+
+	return nil
+}
+
+// Close stops watching for SIGUSR1 and closes the file
+func (s *FileShipper) Close() error {
+	if s.reopen != nil {
+		signal.Stop(s.reopen)
+		close(s.reopen)
+		s.reopen = nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// watch closes the file on every signal, so the next batch
+// opens a new one after an external logrotate moved it away
+func (s *FileShipper) watch(reopen chan os.Signal) {
+	for range reopen {
+		s.mu.Lock()
+		if s.file != nil {
+			logrus.Info(fmt.Sprintf("%s: reopening %s", s.section, s.path))
+			s.file.Close()
+			s.file = nil
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *FileShipper) open() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	// an existing file last written in an earlier interval is
+	// rotated before anything is added to it
+	s.file, s.size, s.opened = file, info.Size(), time.Now()
+	if s.size > 0 {
+		s.opened = info.ModTime()
+	}
+	return nil
+}
+
+func (s *FileShipper) write(line []byte) error {
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("writing to %s failed: %v", s.path, err)
+	}
+	return nil
+}
+
+// due is true when adding n bytes would take the file over its
+// maximum size, or when the rotation interval has passed since
+// it was opened. Intervals are aligned, so that a daily interval
+// rotates at midnight UTC.
+func (s *FileShipper) due(n int64) bool {
+	if s.size == 0 {
+		return false
+	}
+	if s.maxSize > 0 && s.size+n > s.maxSize {
+		return true
+	}
+	if s.rotateInterval > 0 && !time.Now().Truncate(s.rotateInterval).Equal(s.opened.Truncate(s.rotateInterval)) {
+		return true
+	}
+	return false
+}
+
+// rotate shifts the kept files up by one, moves the current
+// file to path.1, compressing it if needed, and opens a new one
+func (s *FileShipper) rotate() error {
+	s.file.Close()
+	s.file = nil
+
+	suffix := ""
+	if s.compress {
+		suffix = ".gz"
+	}
+
+	if s.keep <= 0 {
+		os.Remove(s.path)
+		return s.open()
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d%s", s.path, s.keep, suffix))
+	for i := s.keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d%s", s.path, i, suffix), fmt.Sprintf("%s.%d%s", s.path, i+1, suffix))
+	}
+
+	rotated := fmt.Sprintf("%s.1", s.path)
+	if err := os.Rename(s.path, rotated); err != nil {
+		logrus.Warning(fmt.Sprintf("%s: rotating %s failed: %s", s.section, s.path, err))
+	} else if s.compress {
+		if err := compressFile(rotated); err != nil {
+			logrus.Warning(fmt.Sprintf("%s: compressing %s failed: %s", s.section, rotated, err))
+		}
+	}
+
+	return s.open()
+}
+
+// compressFile replaces a file with a gzipped copy of it
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+
+	w := gzip.NewWriter(out)
+	_, err = io.Copy(w, in)
+	if err == nil {
+		err = w.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (s *FileShipper) serialize(item *structs.Metric) []byte {
+	switch s.format {
+	case "graphite":
+		if key, ok := item.RenderTemplate(s.template, s.prefix); ok {
+			return []byte(fmt.Sprintf("%s %v %d\n", key, item.Value, int32(item.Timestamp.Unix())))
+		}
+		return []byte(item.ToGraphite(s.prefix) + "\n")
+	case "csv":
+		var data []string
+		for k, v := range item.Data {
+			data = append(data, fmt.Sprintf("%s=%v", k, v))
+		}
+		sort.Strings(data)
+
+		return s.csvLine([]string{
+			strconv.FormatInt(item.Timestamp.Unix(), 10),
+			item.Host,
+			item.From,
+			item.Path,
+			item.Name,
+			item.MetricType,
+			fmt.Sprintf("%v", item.Value),
+			strings.Join(data, ";"),
+		})
+	}
+
+	serialized := item.ToJSON()
+	if serialized == nil {
+		return nil
+	}
+	return append(serialized, '\n')
+}
+
+func (s *FileShipper) csvLine(fields []string) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(fields)
+	w.Flush()
+	return buf.Bytes()
+}
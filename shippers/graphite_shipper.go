@@ -1,9 +1,14 @@
 package shippers
 
+import "bytes"
+import "encoding/binary"
 import "fmt"
+import "math"
 import "net"
 import "net/url"
+import "sort"
 import "strings"
+import "sync"
 import "time"
 import "github.com/mike-a-davis/metricsd/structs"
 import "github.com/Sirupsen/logrus"
@@ -12,11 +17,36 @@ import "github.com/vaughan0/go-ini"
 // GraphiteShipper is an exported type that
 // allows shipping metrics to graphite
 type GraphiteShipper struct {
-	debug   bool
-	enabled bool
-	host    string
-	prefix  string
-	port    string
+	debug       bool
+	enabled     bool
+	host        string
+	prefix      string
+	port        string
+	protocol    string
+	tagged      bool
+	tags        map[string]bool
+	template    *structs.NameTemplate
+	timeout     time.Duration
+	packetSize  int
+	con         net.Conn
+	failures    int
+	nextAttempt time.Time
+	mu          sync.Mutex
+	section     string
+}
+
+var graphiteNameReplacer = strings.NewReplacer(";", "_", " ", "_", "\n", "_")
+
+var graphitePorts = map[string]string{
+	"plaintext": "2003",
+	"pickle":    "2004",
+	"udp":       "2003",
+}
+
+func init() {
+	Register("GraphiteShipper", func(section string) ShipperInterface {
+		return &GraphiteShipper{section: section}
+	})
 }
 
 // Enabled allows checking whether the shipper is enabled or not
@@ -33,37 +63,63 @@ func (s *GraphiteShipper) State(state bool) {
 func (s *GraphiteShipper) Setup(conf ini.File) {
 	s.State(true)
 
-	useDebug, ok := conf.Get("GraphiteShipper", "debug")
+	useDebug, ok := conf.Get(s.section, "debug")
 	if ok && useDebug == "true" {
 		s.debug = true
 	} else {
 		s.debug = false
 	}
 
+	s.protocol = "plaintext"
+	if protocol, ok := conf.Get(s.section, "protocol"); ok {
+		if _, ok := graphitePorts[protocol]; ok {
+			s.protocol = protocol
+		} else {
+			logrus.Warning(fmt.Sprintf("%s: invalid protocol %s, using plaintext", s.section, protocol))
+		}
+	}
+	defaultPort := graphitePorts[s.protocol]
+
 	s.host = "127.0.0.1"
-	s.port = "2003"
-	useGraphiteURL, ok := conf.Get("GraphiteShipper", "url")
+	s.port = defaultPort
+	useGraphiteURL, ok := conf.Get(s.section, "url")
 	if ok {
 		graphiteURL, err := url.Parse(useGraphiteURL)
 		if err == nil {
 			splitted := strings.Split(graphiteURL.Host, ":")
-			s.host, s.port = splitted[0], "2003"
+			s.host, s.port = splitted[0], defaultPort
 			switch {
 			case len(splitted) > 2:
-				logrus.Warning("error parsing graphite url")
-				logrus.Warning("using default 127.0.0.1:2003 for graphite url")
+				logrus.Warning(fmt.Sprintf("%s: error parsing graphite url", s.section))
+				logrus.Warning(fmt.Sprintf("%s: using default 127.0.0.1:%s for graphite url", s.section, defaultPort))
 			case len(splitted) > 1:
 				s.host, s.port = splitted[0], splitted[1]
 			default:
-				s.host, s.port = splitted[0], "2003"
+				s.host, s.port = splitted[0], defaultPort
 			}
 		} else {
-			logrus.Warning("error parsing graphite url: %s", err)
-			logrus.Warning("using default 127.0.0.1:2003 for graphite url")
+			logrus.Warning(fmt.Sprintf("%s: error parsing graphite url: %s", s.section, err))
+			logrus.Warning(fmt.Sprintf("%s: using default 127.0.0.1:%s for graphite url", s.section, defaultPort))
+		}
+	}
+
+	s.timeout = time.Duration(getInt(conf, s.section, "timeout", 10)) * time.Second
+	s.packetSize = getInt(conf, s.section, "packet_size", 1432)
+
+	useTagged, ok := conf.Get(s.section, "tagged")
+	s.tagged = ok && useTagged == "true"
+
+	s.tags = nil
+	if tags, ok := conf.Get(s.section, "tags"); ok {
+		s.tags = map[string]bool{}
+		for _, tag := range strings.Split(tags, ",") {
+			s.tags[strings.TrimSpace(tag)] = true
 		}
 	}
 
-	usePrefix, ok := conf.Get("GraphiteShipper", "prefix")
+	s.template = getTemplate(conf, s.section)
+
+	usePrefix, ok := conf.Get(s.section, "prefix")
 	if ok {
 		s.prefix = fmt.Sprintf("%s.", usePrefix)
 	}
@@ -71,20 +127,221 @@ func (s *GraphiteShipper) Setup(conf ini.File) {
 
 // Ship sends a list of MetricSlices to graphite
 func (s *GraphiteShipper) Ship(logs structs.MetricSlice) error {
-	con, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%s", s.host, s.port), 1*time.Second)
+	var payloads [][]byte
+	switch s.protocol {
+	case "pickle":
+		if payload := s.pickle(logs); payload != nil {
+			payloads = append(payloads, payload)
+		}
+	case "udp":
+		payloads = s.datagrams(logs)
+	default:
+		var buf bytes.Buffer
+		for _, item := range logs {
+			buf.WriteString(s.serialize(item))
+			buf.WriteByte('\n')
+		}
+		payloads = append(payloads, buf.Bytes())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	for _, payload := range payloads {
+		if len(payload) == 0 {
+			continue
+		}
+		s.con.SetWriteDeadline(time.Now().Add(s.timeout))
+		if _, err := s.con.Write(payload); err != nil {
+			logrus.Warning(fmt.Sprintf("%s: writing to graphite failed with err: %s", s.section, err))
+			s.con.Close()
+			s.con = nil
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the connection to graphite
+func (s *GraphiteShipper) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.con == nil {
+		return nil
+	}
+	err := s.con.Close()
+	s.con = nil
+	return err
+}
+
+// connect opens the connection to graphite unless it is already
+// open, waiting longer after every failed attempt before trying
+// again. It must be called with the shipper locked.
+func (s *GraphiteShipper) connect() error {
+	if s.con != nil {
+		return nil
+	}
+	if time.Now().Before(s.nextAttempt) {
+		return fmt.Errorf("waiting until %s to reconnect to graphite", s.nextAttempt.Format(time.RFC3339))
+	}
+
+	network := "tcp"
+	if s.protocol == "udp" {
+		network = "udp"
+	}
+
+	con, err := net.DialTimeout(network, net.JoinHostPort(s.host, s.port), 1*time.Second)
 	if err != nil {
-		logrus.Warning("connecting to graphite failed with err: ", err)
+		s.failures++
+		s.nextAttempt = time.Now().Add(backoff(s.failures))
+		logrus.Warning(fmt.Sprintf("%s: connecting to graphite failed with err: %s", s.section, err))
 		return err
 	}
-	defer con.Close()
 
+	s.failures = 0
+	s.con = con
+	return nil
+}
+
+func (s *GraphiteShipper) serialize(item *structs.Metric) string {
+	serialized := fmt.Sprintf("%s %v %d", s.key(item), item.Value, int32(item.Timestamp.Unix()))
+	if s.debug {
+		fmt.Printf("%s\n", serialized)
+	}
+	return serialized
+}
+
+// datagrams packs plaintext lines into as few datagrams as
+// possible without going over the packet size
+func (s *GraphiteShipper) datagrams(logs structs.MetricSlice) [][]byte {
+	var datagrams [][]byte
+	var buf bytes.Buffer
+	for _, item := range logs {
+		line := s.serialize(item)
+		if buf.Len() > 0 && buf.Len()+len(line)+1 > s.packetSize {
+			datagrams = append(datagrams, append([]byte(nil), buf.Bytes()...))
+			buf.Reset()
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	if buf.Len() > 0 {
+		datagrams = append(datagrams, buf.Bytes())
+	}
+	return datagrams
+}
+
+// pickle encodes the numeric metrics as a length prefixed pickled
+// list of (path, (timestamp, value)) tuples, as read by the carbon
+// pickle receiver
+func (s *GraphiteShipper) pickle(logs structs.MetricSlice) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("\x80\x02") // PROTO 2
+	buf.WriteString("](")       // EMPTY_LIST, MARK
+
+	count := 0
 	for _, item := range logs {
-		serialized := item.ToGraphite(s.prefix)
+		value, ok := item.Float()
+		if !ok {
+			continue
+		}
+		key := s.key(item)
 		if s.debug {
-			fmt.Printf("%s\n", serialized)
+			fmt.Printf("%s %v %d\n", key, value, int32(item.Timestamp.Unix()))
 		}
-		fmt.Fprintln(con, serialized)
+
+		buf.WriteByte('X') // BINUNICODE
+		binary.Write(&buf, binary.LittleEndian, uint32(len(key)))
+		buf.WriteString(key)
+		buf.WriteByte('J') // BININT
+		binary.Write(&buf, binary.LittleEndian, int32(item.Timestamp.Unix()))
+		buf.WriteByte('G') // BINFLOAT
+		binary.Write(&buf, binary.BigEndian, math.Float64bits(value))
+		buf.WriteString("\x86\x86") // TUPLE2, TUPLE2
+		count++
+	}
+	if count == 0 {
+		return nil
 	}
+	buf.WriteString("e.") // APPENDS, STOP
 
-	return nil
+	payload := make([]byte, 4, 4+buf.Len())
+	binary.BigEndian.PutUint32(payload, uint32(buf.Len()))
+	return append(payload, buf.Bytes()...)
+}
+
+// key returns the dotted path of the metric or, when tagged
+// series are enabled, the path without the host followed by
+// the host and the selected fields as tags
+func (s *GraphiteShipper) key(item *structs.Metric) string {
+	if !s.tagged {
+		if key, ok := item.RenderTemplate(s.template, s.prefix); ok {
+			return key
+		}
+		return item.GraphiteKey(s.prefix)
+	}
+
+	path := item.From
+	if item.Path != "" {
+		path = item.Path
+	}
+	name := graphiteNameReplacer.Replace(fmt.Sprintf("%s%s.%s", s.prefix, path, item.Name))
+
+	tags := map[string]string{}
+	if s.tags == nil || s.tags["host"] {
+		tags["host"] = item.Host
+	}
+	for _, fields := range []structs.FieldsMap{item.Data, item.Tags} {
+		for k, v := range fields {
+			if v == nil || (s.tags == nil && k == "raw_value") || (s.tags != nil && !s.tags[k]) {
+				continue
+			}
+			tags[k] = fmt.Sprintf("%v", v)
+		}
+	}
+
+	var pairs []string
+	for k, v := range tags {
+		k, v = graphiteTagName(k), graphiteTagValue(v)
+		// name is reserved for the series name itself
+		if k == "" || v == "" || k == "name" {
+			continue
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(append([]string{name}, pairs...), ";")
+}
+
+// graphiteTagName replaces the characters graphite does not
+// allow in tag names, along with anything that is not printable ascii
+func graphiteTagName(name string) string {
+	var buf bytes.Buffer
+	for _, r := range name {
+		if r <= ' ' || r > '~' || strings.ContainsRune(";!^=", r) {
+			r = '_'
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// graphiteTagValue replaces the characters graphite does not allow
+// in tag values, which also may not start with a tilde
+func graphiteTagValue(value string) string {
+	var buf bytes.Buffer
+	for i, r := range value {
+		if r <= ' ' || r > '~' || r == ';' || (i == 0 && r == '~') {
+			r = '_'
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
 }
@@ -0,0 +1,40 @@
+package shippers
+
+import "bytes"
+import "testing"
+import "time"
+import "github.com/mike-a-davis/metricsd/structs"
+
+func TestGraphitePickle(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	load := &structs.Metric{Host: "h", From: "load", Name: "one", Value: 1.5, Timestamp: at}
+	text := &structs.Metric{Host: "h", From: "load", Name: "state", Value: "n/a", Timestamp: at}
+
+	// [("h.load.one", (1700000000, 1.5))], pickled with protocol 2
+	// behind its length as a big endian uint32
+	onePoint := []byte("\x00\x00\x00\x25" +
+		"\x80\x02](" +
+		"X\x0a\x00\x00\x00h.load.one" +
+		"J\x00\xf1\x53\x65" +
+		"G\x3f\xf8\x00\x00\x00\x00\x00\x00" +
+		"\x86\x86" +
+		"e.")
+
+	tests := []struct {
+		name string
+		logs structs.MetricSlice
+		want []byte
+	}{
+		{"numeric", structs.MetricSlice{load}, onePoint},
+		{"skips values that are not numeric", structs.MetricSlice{text, load}, onePoint},
+		{"nothing numeric", structs.MetricSlice{text}, nil},
+		{"empty", nil, nil},
+	}
+
+	s := &GraphiteShipper{}
+	for _, test := range tests {
+		if got := s.pickle(test.logs); !bytes.Equal(got, test.want) {
+			t.Errorf("%s: pickle = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
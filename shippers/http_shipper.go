@@ -0,0 +1,263 @@
+package shippers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mike-a-davis/metricsd/structs"
+	"github.com/vaughan0/go-ini"
+)
+
+// HttpShipper is an exported type that allows shipping
+// metrics to any http endpoint with a templated body
+type HttpShipper struct {
+	enabled     bool
+	debug       bool
+	url         string
+	method      string
+	headers     map[string]string
+	body        *template.Template
+	perMetric   bool
+	gzip        bool
+	success     [][2]int
+	retryStatus [][2]int
+	client      *http.Client
+	section     string
+}
+
+var httpTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"unix": func(t time.Time) int64 {
+		return t.Unix()
+	},
+	"join": httpJoin,
+}
+
+func init() {
+	Register("HttpShipper", func(section string) ShipperInterface {
+		return &HttpShipper{section: section}
+	})
+}
+
+// Enabled allows checking whether the shipper is enabled or not
+func (s *HttpShipper) Enabled() bool {
+	return s.enabled
+}
+
+// State allows setting the enabled state of the shipper
+func (s *HttpShipper) State(state bool) {
+	s.enabled = state
+}
+
+// Setup configures the shipper
+func (s *HttpShipper) Setup(conf ini.File) {
+	s.State(true)
+
+	useDebug, ok := conf.Get(s.section, "debug")
+	s.debug = ok && useDebug == "true"
+
+	s.url = "http://127.0.0.1:8080/"
+	if url, ok := conf.Get(s.section, "url"); ok {
+		s.url = url
+	}
+
+	s.method = "POST"
+	if method, ok := conf.Get(s.section, "method"); ok {
+		s.method = strings.ToUpper(method)
+	}
+
+	// headers are set as header.Name = value, since ini
+	// sections can't be nested
+	s.headers = map[string]string{"Content-Type": "application/json"}
+	for key, value := range conf[s.section] {
+		if strings.HasPrefix(key, "header.") {
+			s.headers[strings.TrimPrefix(key, "header.")] = value
+		}
+	}
+
+	body := "{{json .}}"
+	if bodyFile, ok := conf.Get(s.section, "body_file"); ok {
+		data, err := ioutil.ReadFile(bodyFile)
+		if err != nil {
+			logrus.Warning(fmt.Sprintf("%s: reading body_file failed: %s", s.section, err))
+		} else {
+			body = string(data)
+		}
+	} else if b, ok := conf.Get(s.section, "body"); ok {
+		body = b
+	}
+
+	var err error
+	s.body, err = template.New(s.section).Funcs(httpTemplateFuncs).Parse(body)
+	if err != nil {
+		logrus.Warning(fmt.Sprintf("%s: parsing body failed, using {{json .}}: %s", s.section, err))
+		s.body = template.Must(template.New(s.section).Funcs(httpTemplateFuncs).Parse("{{json .}}"))
+	}
+
+	s.perMetric = false
+	if per, ok := conf.Get(s.section, "body_per"); ok {
+		switch per {
+		case "batch":
+		case "metric":
+			s.perMetric = true
+		default:
+			logrus.Warning(fmt.Sprintf("%s: invalid body_per %s, using batch", s.section, per))
+		}
+	}
+
+	useGzip, ok := conf.Get(s.section, "gzip")
+	s.gzip = ok && useGzip == "true"
+
+	s.success = s.getStatusRanges(conf, "success_status", "200-299")
+	s.retryStatus = s.getStatusRanges(conf, "retry_status", "408,429,500-599")
+
+	timeout := time.Duration(getInt(conf, s.section, "timeout", 10)) * time.Second
+	s.client = &http.Client{Timeout: timeout}
+}
+
+// Ship renders the body template for the whole batch, or for
+// every metric in it, and sends the result
+func (s *HttpShipper) Ship(logs structs.MetricSlice) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	if !s.perMetric {
+		return s.send(logs)
+	}
+
+	return shipEach(s.section, logs, func(item *structs.Metric) error {
+		return s.send(item)
+	})
+}
+
+func (s *HttpShipper) send(data interface{}) error {
+	var body bytes.Buffer
+	if err := s.body.Execute(&body, data); err != nil {
+		return &PermanentError{fmt.Errorf("rendering body failed: %v", err)}
+	}
+	if s.debug {
+		fmt.Printf("%s\n", body.String())
+	}
+
+	payload := body.Bytes()
+	if s.gzip {
+		var compressed bytes.Buffer
+		w := gzip.NewWriter(&compressed)
+		w.Write(payload)
+		w.Close()
+		payload = compressed.Bytes()
+	}
+
+	req, err := http.NewRequest(s.method, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+	if s.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to make request, %v", err)
+	}
+	defer resp.Body.Close()
+	response, _ := ioutil.ReadAll(resp.Body)
+	if s.debug {
+		fmt.Println("response Status:", resp.Status)
+		fmt.Println("response Body:", string(response))
+	}
+
+	if inStatusRanges(s.success, resp.StatusCode) {
+		return nil
+	}
+
+	if len(response) > 256 {
+		response = response[:256]
+	}
+	err = fmt.Errorf("request failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(response)))
+	if inStatusRanges(s.retryStatus, resp.StatusCode) {
+		return err
+	}
+	return &PermanentError{err}
+}
+
+// getStatusRanges reads a list of status codes, falling back
+// to the default when it is invalid
+func (s *HttpShipper) getStatusRanges(conf ini.File, key string, defaultValue string) [][2]int {
+	if value, ok := conf.Get(s.section, key); ok {
+		ranges, err := parseStatusRanges(value)
+		if err == nil {
+			return ranges
+		}
+		logrus.Warning(fmt.Sprintf("%s: invalid %s, using %s: %s", s.section, key, defaultValue, err))
+	}
+
+	ranges, _ := parseStatusRanges(defaultValue)
+	return ranges
+}
+
+// parseStatusRanges parses a comma-separated list of status
+// codes and ranges of them, such as 200,202-204
+func parseStatusRanges(value string) ([][2]int, error) {
+	var ranges [][2]int
+	for _, part := range strings.Split(value, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		low, err := strconv.Atoi(bounds[0])
+		high := low
+		if err == nil && len(bounds) == 2 {
+			high, err = strconv.Atoi(bounds[1])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid status %q", part)
+		}
+		ranges = append(ranges, [2]int{low, high})
+	}
+	return ranges, nil
+}
+
+func inStatusRanges(ranges [][2]int, status int) bool {
+	for _, r := range ranges {
+		if status >= r[0] && status <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// httpJoin joins the elements of a slice, or the sorted
+// key=value pairs of a map, with a separator
+func httpJoin(sep string, values interface{}) string {
+	v := reflect.ValueOf(values)
+	var parts []string
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			parts = append(parts, fmt.Sprintf("%v", v.Index(i).Interface()))
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			parts = append(parts, fmt.Sprintf("%v=%v", key.Interface(), v.MapIndex(key).Interface()))
+		}
+		sort.Strings(parts)
+	default:
+		return fmt.Sprintf("%v", values)
+	}
+	return strings.Join(parts, sep)
+}
@@ -0,0 +1,76 @@
+package shippers
+
+import "reflect"
+import "testing"
+
+func TestParseStatusRanges(t *testing.T) {
+	tests := []struct {
+		value string
+		want  [][2]int
+	}{
+		{"200", [][2]int{{200, 200}}},
+		{"200-299", [][2]int{{200, 299}}},
+		{"200-299, 304", [][2]int{{200, 299}, {304, 304}}},
+		{"429,500-599", [][2]int{{429, 429}, {500, 599}}},
+	}
+
+	for _, test := range tests {
+		got, err := parseStatusRanges(test.value)
+		if err != nil {
+			t.Errorf("parseStatusRanges(%q): %s", test.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseStatusRanges(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+
+	for _, value := range []string{"", "ok", "200-", "-299", "200-2xx", "200,,204"} {
+		if _, err := parseStatusRanges(value); err == nil {
+			t.Errorf("parseStatusRanges(%q) returned no error", value)
+		}
+	}
+}
+
+func TestInStatusRanges(t *testing.T) {
+	ranges := [][2]int{{200, 299}, {304, 304}}
+
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{200, true},
+		{299, true},
+		{304, true},
+		{199, false},
+		{300, false},
+		{500, false},
+	}
+
+	for _, test := range tests {
+		if got := inStatusRanges(ranges, test.status); got != test.want {
+			t.Errorf("inStatusRanges(%d) = %v, want %v", test.status, got, test.want)
+		}
+	}
+}
+
+func TestHTTPJoin(t *testing.T) {
+	tests := []struct {
+		sep    string
+		values interface{}
+		want   string
+	}{
+		{",", []string{"a", "b", "c"}, "a,b,c"},
+		{" ", []interface{}{1, "two", 3.5}, "1 two 3.5"},
+		{",", [2]int{4, 5}, "4,5"},
+		{";", map[string]interface{}{"b": 2, "a": "x"}, "a=x;b=2"},
+		{",", []string{}, ""},
+		{",", 42, "42"},
+	}
+
+	for _, test := range tests {
+		if got := httpJoin(test.sep, test.values); got != test.want {
+			t.Errorf("httpJoin(%q, %v) = %q, want %q", test.sep, test.values, got, test.want)
+		}
+	}
+}
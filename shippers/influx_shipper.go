@@ -0,0 +1,233 @@
+package shippers
+
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "net/url"
+import "sort"
+import "strconv"
+import "strings"
+import "time"
+import "github.com/mike-a-davis/metricsd/structs"
+import "github.com/Sirupsen/logrus"
+import "github.com/vaughan0/go-ini"
+
+// InfluxShipper is an exported type that
+// allows shipping metrics to influxdb in line protocol
+type InfluxShipper struct {
+	enabled       bool
+	url           string
+	version       string
+	db            string
+	rp            string
+	user          string
+	password      string
+	org           string
+	bucket        string
+	token         string
+	precision     string
+	excludeLabels map[string]bool
+	client        *http.Client
+	section       string
+}
+
+// precisions maps each supported precision to its duration and
+// the name used by the v1 and v2 write endpoints respectively
+var influxPrecisions = map[string]struct {
+	unit time.Duration
+	v1   string
+	v2   string
+}{
+	"ns": {time.Nanosecond, "n", "ns"},
+	"us": {time.Microsecond, "u", "us"},
+	"ms": {time.Millisecond, "ms", "ms"},
+	"s":  {time.Second, "s", "s"},
+}
+
+var influxMeasurementEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ")
+var influxTagEscaper = strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ")
+var influxStringEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"")
+
+func init() {
+	Register("InfluxShipper", func(section string) ShipperInterface {
+		return &InfluxShipper{section: section}
+	})
+}
+
+// Enabled allows checking whether the shipper is enabled or not
+func (s *InfluxShipper) Enabled() bool {
+	return s.enabled
+}
+
+// State allows setting the enabled state of the shipper
+func (s *InfluxShipper) State(state bool) {
+	s.enabled = state
+}
+
+// Setup configures the shipper
+func (s *InfluxShipper) Setup(conf ini.File) {
+	s.State(true)
+
+	s.url = "http://127.0.0.1:8086"
+	if address, ok := conf.Get(s.section, "url"); ok {
+		s.url = strings.TrimRight(address, "/")
+	}
+
+	s.version = "1"
+	if version, ok := conf.Get(s.section, "version"); ok {
+		if version == "1" || version == "2" {
+			s.version = version
+		} else {
+			logrus.Warning(fmt.Sprintf("%s: invalid version %s, using 1", s.section, version))
+		}
+	}
+
+	s.db = "metricsd"
+	if db, ok := conf.Get(s.section, "db"); ok {
+		s.db = db
+	}
+	s.rp, _ = conf.Get(s.section, "rp")
+	s.user, _ = conf.Get(s.section, "user")
+	s.password, _ = conf.Get(s.section, "password")
+	s.org, _ = conf.Get(s.section, "org")
+	s.bucket, _ = conf.Get(s.section, "bucket")
+	s.token, _ = conf.Get(s.section, "token")
+
+	precision := "s"
+	if p, ok := conf.Get(s.section, "precision"); ok {
+		if _, ok := influxPrecisions[p]; ok {
+			precision = p
+		} else {
+			logrus.Warning(fmt.Sprintf("%s: invalid precision %s, using s", s.section, p))
+		}
+	}
+	s.precision = precision
+
+	s.excludeLabels = getLabelSet(conf, s.section)
+
+	timeout := time.Duration(getInt(conf, s.section, "timeout", 10)) * time.Second
+	s.client = &http.Client{Timeout: timeout}
+}
+
+// Ship sends a list of MetricSlices to influxdb
+func (s *InfluxShipper) Ship(logs structs.MetricSlice) error {
+	var lines []string
+	for _, item := range logs {
+		if line, ok := s.line(item); ok {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	req, err := http.NewRequest("POST", s.writeURL(), strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.version == "2" {
+		req.Header.Set("Authorization", fmt.Sprintf("Token %s", s.token))
+	} else if s.user != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to make request, %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusBadRequest:
+		// influx writes the points it could parse and reports
+		// the rest, which are malformed and can't be retried
+		s.logWriteErrors(body)
+		return nil
+	}
+	return fmt.Errorf("writing to influxdb failed with status: %d", resp.StatusCode)
+}
+
+func (s *InfluxShipper) writeURL() string {
+	values := url.Values{}
+	if s.version == "2" {
+		values.Set("precision", influxPrecisions[s.precision].v2)
+		values.Set("org", s.org)
+		values.Set("bucket", s.bucket)
+		return fmt.Sprintf("%s/api/v2/write?%s", s.url, values.Encode())
+	}
+
+	values.Set("precision", influxPrecisions[s.precision].v1)
+	values.Set("db", s.db)
+	if s.rp != "" {
+		values.Set("rp", s.rp)
+	}
+	return fmt.Sprintf("%s/write?%s", s.url, values.Encode())
+}
+
+// line renders a metric in line protocol, with From as the
+// measurement, the host and Data entries as tags and Name as
+// the field key. Metrics without a value are skipped.
+func (s *InfluxShipper) line(item *structs.Metric) (string, bool) {
+	var field string
+	if value, ok := item.Float(); ok {
+		field = strconv.FormatFloat(value, 'f', -1, 64)
+	} else if value, ok := item.Value.(string); ok {
+		field = fmt.Sprintf("\"%s\"", influxStringEscaper.Replace(value))
+	} else {
+		return "", false
+	}
+
+	tags := map[string]string{"host": item.Host}
+	for k, v := range item.Data {
+		if s.excludeLabels[k] || v == nil {
+			continue
+		}
+		if value := fmt.Sprintf("%v", v); value != "" {
+			tags[k] = value
+		}
+	}
+
+	var keys []string
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteString(influxMeasurementEscaper.Replace(item.From))
+	for _, k := range keys {
+		fmt.Fprintf(&buf, ",%s=%s", influxTagEscaper.Replace(k), influxTagEscaper.Replace(tags[k]))
+	}
+	fmt.Fprintf(&buf, " %s=%s %d", influxTagEscaper.Replace(item.Name), field, item.Timestamp.UnixNano()/int64(influxPrecisions[s.precision].unit))
+
+	return buf.String(), true
+}
+
+// logWriteErrors logs every line of the error returned for a
+// partial write. v1 puts it in "error", v2 in "message".
+func (s *InfluxShipper) logWriteErrors(body []byte) {
+	var response struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+
+	message := string(body)
+	if err := json.Unmarshal(body, &response); err == nil {
+		message = response.Error
+		if message == "" {
+			message = response.Message
+		}
+	}
+
+	for _, line := range strings.Split(message, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			logrus.Warning(fmt.Sprintf("%s: influxdb rejected points: %s", s.section, line))
+		}
+	}
+}
@@ -3,8 +3,13 @@ package shippers
 import "bytes"
 import "encoding/json"
 import "fmt"
+import "io/ioutil"
 import "net/http"
+import "strconv"
+import "strings"
+import "time"
 import "github.com/Sirupsen/logrus"
+import "github.com/mike-a-davis/metricsd/stats"
 import "github.com/mike-a-davis/metricsd/structs"
 import "github.com/mike-a-davis/metricsd/utils"
 import "github.com/vaughan0/go-ini"
@@ -12,13 +17,37 @@ import "github.com/vaughan0/go-ini"
 type actionMap map[string]indexMap
 type indexMap map[string]string
 
+// bulkResponse is the part of a bulk API response that
+// reports the outcome of every action
+type bulkResponse struct {
+	Errors bool                    `json:"errors"`
+	Items  []map[string]bulkResult `json:"items"`
+}
+
+type bulkResult struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
 // LogstashElasticsearchShipper is an exported type that
 // allows shipping metrics to elasticsearch in logstash format
 type LogstashElasticsearchShipper struct {
-	enabled    bool
-	index      string
-	metricType string
-	url        string
+	enabled         bool
+	index           string
+	metricType      string
+	dataStream      bool
+	templatePattern string
+	url             string
+	major           int
+	minor           int
+	client          *http.Client
+	section         string
+}
+
+func init() {
+	Register("LogstashElasticsearchShipper", func(section string) ShipperInterface {
+		return &LogstashElasticsearchShipper{section: section}
+	})
 }
 
 // Enabled allows checking whether the shipper is enabled or not
@@ -35,82 +64,350 @@ func (s *LogstashElasticsearchShipper) State(state bool) {
 func (s *LogstashElasticsearchShipper) Setup(conf ini.File) {
 	s.State(true)
 
-	if url, ok := conf.Get("LogstashElasticsearchShipper", "url"); ok {
+	if url, ok := conf.Get(s.section, "url"); ok {
 		s.url = url
 	} else {
 		s.url = "http://127.0.0.1:9200"
 	}
 
-	if index, ok := conf.Get("LogstashElasticsearchShipper", "index"); ok {
+	if index, ok := conf.Get(s.section, "index"); ok {
 		s.index = index
 	} else {
 		s.index = "metricsd-data"
 	}
 
-	if metricType, ok := conf.Get("LogstashElasticsearchShipper", "type"); ok {
+	if metricType, ok := conf.Get(s.section, "type"); ok {
 		s.metricType = metricType
 	} else {
 		s.metricType = "metricsd"
 	}
 
-	s.setupTemplate()
+	useDataStream, ok := conf.Get(s.section, "data_stream")
+	s.dataStream = ok && useDataStream == "true"
+	if s.dataStream && strings.Contains(s.index, "%") {
+		logrus.Warning(fmt.Sprintf("%s: data streams roll over by themselves, date patterns in %s are still resolved", s.section, s.index))
+	}
+
+	// a data stream is only created for a name that matches
+	// a template with data streams enabled
+	s.templatePattern = "metricsd-*"
+	if s.dataStream {
+		s.templatePattern = utils.StrftimeGlob(s.index)
+	}
+	if templatePattern, ok := conf.Get(s.section, "template_pattern"); ok {
+		s.templatePattern = templatePattern
+	}
+
+	timeout := time.Duration(getInt(conf, s.section, "timeout", 10)) * time.Second
+	s.client = &http.Client{Timeout: timeout}
+
+	// the cluster may not be up yet, in which case the version
+	// is detected again before the first batch is shipped
+	s.major, s.minor = 0, 0
+	if err := s.prepare(); err != nil {
+		logrus.Warning(fmt.Sprintf("%s: %s", s.section, err))
+	}
 }
 
 // Ship sends a list of MetricSlices to elasticsearch
 func (s *LogstashElasticsearchShipper) Ship(logs structs.MetricSlice) error {
-	action := actionMap{
-		"index": indexMap{
-			"_index": s.index,
-			"_type":  s.metricType,
-		},
+	if s.major == 0 {
+		if err := s.prepare(); err != nil {
+			return err
+		}
 	}
-	serializedAction, err := json.Marshal(action)
-	if err != nil {
-		return fmt.Errorf("Failed to marshal action to JSON, %v", err)
+
+	// data streams only accept create actions, while older
+	// clusters write to a regular index with index actions
+	op := "index"
+	if s.dataStream && s.supportsDataStreams() {
+		op = "create"
 	}
 
 	var slice []byte
+	var sent structs.MetricSlice
 	newline := []byte("\n")
+	actions := map[string][]byte{}
 
 	for _, item := range logs {
+		// the index is resolved per metric, so a batch spanning
+		// midnight is split between two daily indices
+		index := utils.Strftime(s.index, item.Timestamp.UTC())
+		serializedAction, ok := actions[index]
+		if !ok {
+			action := actionMap{
+				op: indexMap{
+					"_index": index,
+				},
+			}
+			// mapping types were removed in elasticsearch 7
+			if s.major < 7 {
+				action[op]["_type"] = s.metricType
+			}
+
+			var err error
+			serializedAction, err = json.Marshal(action)
+			if err != nil {
+				return fmt.Errorf("Failed to marshal action to JSON, %v", err)
+			}
+			actions[index] = serializedAction
+		}
+
 		serialized := item.ToJSON()
+		if s.dataStream {
+			data := item.ToMap()
+			data["@timestamp"] = item.Timestamp.UTC().Format(time.RFC3339Nano)
+			serialized, _ = json.Marshal(data)
+		}
+		if serialized == nil {
+			continue
+		}
+
 		slice = utils.Extend(slice, serializedAction)
 		slice = utils.Extend(slice, newline)
 		slice = utils.Extend(slice, serialized)
 		slice = utils.Extend(slice, newline)
+		sent = append(sent, item)
+	}
+	if len(sent) == 0 {
+		return nil
 	}
 
-	status, err := s.elasticsearchPost("/_bulk", slice)
+	status, body, err := s.elasticsearchRequest("POST", "/_bulk", slice)
 	if err != nil {
-		logrus.Warning("indexing serialized data failed with err: ", err)
+		return fmt.Errorf("indexing serialized data failed with err: %v", err)
 	}
 
 	if status != http.StatusOK {
-		logrus.Warning("indexing serialized data failed with status: ", status)
+		return fmt.Errorf("indexing serialized data failed with status: %d", status)
+	}
+	return s.checkItems(sent, body)
+}
+
+// checkItems reads the outcome of every action of a bulk request,
+// which succeeds as a whole even when documents are rejected.
+// Rejected documents are dropped, while those that hit a full
+// queue or a failing node are returned to be retried.
+func (s *LogstashElasticsearchShipper) checkItems(sent structs.MetricSlice, body []byte) error {
+	var response bulkResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		logrus.Warning(fmt.Sprintf("%s: failed to parse bulk response, %v", s.section, err))
+		return nil
+	}
+	if !response.Errors {
+		return nil
+	}
+
+	var retry structs.MetricSlice
+	for i, item := range response.Items {
+		result, ok := item["index"]
+		if !ok {
+			result, ok = item["create"]
+		}
+		if !ok || i >= len(sent) || len(result.Error) == 0 || string(result.Error) == "null" {
+			continue
+		}
+
+		if result.Status == http.StatusTooManyRequests || result.Status >= 500 {
+			retry = append(retry, sent[i])
+			continue
+		}
+		logrus.Warning(fmt.Sprintf("%s: %s rejected with status %d: %s", s.section, sent[i].Name, result.Status, result.Error))
+		stats.RecordDrop(s.section, 1)
+	}
+
+	if len(retry) > 0 {
+		return &PartialError{
+			Err:       fmt.Errorf("indexing %d of %d documents failed", len(retry), len(sent)),
+			Remaining: retry,
+		}
 	}
 	return nil
 }
 
-func (s *LogstashElasticsearchShipper) elasticsearchPost(url string, data []byte) (int, error) {
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s%s", s.url, url), bytes.NewBuffer(data))
-	req.Header.Set("Content-Type", "application/json")
+func (s *LogstashElasticsearchShipper) elasticsearchRequest(method string, url string, data []byte) (int, []byte, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("%s%s", s.url, url), bytes.NewBuffer(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := s.client.Do(req)
 	if err != nil {
 		err = fmt.Errorf("Failed to make request, %v", err)
-		return 0, err
+		return 0, nil, err
 	}
 	defer resp.Body.Close()
 
-	return resp.StatusCode, nil
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
 }
 
-func (s *LogstashElasticsearchShipper) setupTemplate() {
-	template := `
+// prepare detects the version of the cluster and installs the
+// index template matching it
+func (s *LogstashElasticsearchShipper) prepare() error {
+	major, minor, err := s.detectVersion()
+	if err != nil {
+		return fmt.Errorf("detecting elasticsearch version failed: %v", err)
+	}
+	s.major, s.minor = major, minor
+
+	if s.dataStream && !s.supportsDataStreams() {
+		logrus.Warning(fmt.Sprintf("%s: data streams need elasticsearch 7.9 or later, writing to a regular index", s.section))
+	}
+
+	// documents are still indexed without the template, only
+	// with whatever mappings elasticsearch guesses for them
+	if err := s.setupTemplate(); err != nil {
+		logrus.Warning(fmt.Sprintf("%s: creating index template failed: %s", s.section, err))
+	}
+	return nil
+}
+
+// detectVersion reads the version number from the root endpoint.
+// OpenSearch is treated as the elasticsearch release it forked from.
+func (s *LogstashElasticsearchShipper) detectVersion() (int, int, error) {
+	status, body, err := s.elasticsearchRequest("GET", "/", nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	if status != http.StatusOK {
+		return 0, 0, fmt.Errorf("unexpected status %d", status)
+	}
+
+	var info struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return 0, 0, err
+	}
+	if info.Version.Distribution == "opensearch" {
+		return 7, 10, nil
+	}
+
+	parts := strings.SplitN(info.Version.Number, ".", 3)
+	major, err := strconv.Atoi(parts[0])
+	if err != nil || major <= 0 {
+		return 0, 0, fmt.Errorf("invalid version number %q", info.Version.Number)
+	}
+	minor := 0
+	if len(parts) > 1 {
+		minor, _ = strconv.Atoi(parts[1])
+	}
+	return major, minor, nil
+}
+
+// setupTemplate installs the index template in the format the
+// cluster understands: composable templates from 7.8 onwards,
+// typeless legacy templates on 7.0 to 7.7, typed legacy templates
+// with keyword mappings on 6.x and the original string mappings
+// before that
+func (s *LogstashElasticsearchShipper) setupTemplate() error {
+	mappings := map[string]interface{}{
+		"dynamic_templates": []interface{}{
+			map[string]interface{}{
+				"string_fields": map[string]interface{}{
+					"match_mapping_type": "string",
+					"match":              "*",
+					"mapping": map[string]interface{}{
+						"type":         "keyword",
+						"ignore_above": 256,
+					},
+				},
+			},
+			map[string]interface{}{
+				"integer_fields": map[string]interface{}{
+					"match_mapping_type": "long",
+					"match":              "*",
+					"mapping": map[string]interface{}{
+						"type": "double",
+					},
+				},
+			},
+			map[string]interface{}{
+				"float_fields": map[string]interface{}{
+					"match_mapping_type": "double",
+					"match":              "*",
+					"mapping": map[string]interface{}{
+						"type": "double",
+					},
+				},
+			},
+		},
+		"properties": map[string]interface{}{
+			"@version": map[string]interface{}{
+				"type": "keyword",
+			},
+		},
+	}
+	settings := map[string]interface{}{
+		"index.refresh_interval": "5s",
+	}
+
+	var path string
+	var template map[string]interface{}
+	switch {
+	case s.composable():
+		path = "/_index_template/metricsd"
+		template = map[string]interface{}{
+			"index_patterns": []string{s.templatePattern},
+			"priority":       0,
+			"template": map[string]interface{}{
+				"settings": settings,
+				"mappings": mappings,
+			},
+		}
+		if s.dataStream && s.supportsDataStreams() {
+			template["data_stream"] = map[string]interface{}{}
+		}
+	case s.major == 7:
+		path = "/_template/metricsd"
+		template = map[string]interface{}{
+			"order":          0,
+			"index_patterns": []string{s.templatePattern},
+			"settings":       settings,
+			"mappings":       mappings,
+		}
+	case s.major == 6:
+		path = "/_template/metricsd"
+		template = map[string]interface{}{
+			"order":          0,
+			"index_patterns": []string{s.templatePattern},
+			"settings":       settings,
+			"mappings":       map[string]interface{}{s.metricType: mappings},
+		}
+	default:
+		return s.setupLegacyTemplate()
+	}
+
+	data, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+	return s.putTemplate(path, data)
+}
+
+// composable is true for clusters that support composable
+// index templates, added in elasticsearch 7.8
+func (s *LogstashElasticsearchShipper) composable() bool {
+	return s.major > 7 || (s.major == 7 && s.minor >= 8)
+}
+
+// supportsDataStreams is true from elasticsearch 7.9
+func (s *LogstashElasticsearchShipper) supportsDataStreams() bool {
+	return s.major > 7 || (s.major == 7 && s.minor >= 9)
+}
+
+func (s *LogstashElasticsearchShipper) setupLegacyTemplate() error {
+	template := fmt.Sprintf(`
 {
 	"order": 0,
-	"template": "metricsd-*",
+	"template": %q,
 	"settings": {
 		"index.refresh_interval": "5s"
 	},
@@ -149,15 +446,18 @@ func (s *LogstashElasticsearchShipper) setupTemplate() {
 	},
 	"aliases": {}
 }
-`
-	var data = []byte(template)
+`, s.templatePattern)
+	return s.putTemplate("/_template/metricsd", []byte(template))
+}
 
-	status, err := s.elasticsearchPost("/_template/metricsd", data)
+func (s *LogstashElasticsearchShipper) putTemplate(path string, data []byte) error {
+	status, body, err := s.elasticsearchRequest("PUT", path, data)
 	if err != nil {
-		logrus.Fatal("creating index failed: ", err)
+		return err
 	}
 
 	if status != http.StatusOK {
-		logrus.Fatal("creating index failed")
+		return fmt.Errorf("status %d: %s", status, strings.TrimSpace(string(body)))
 	}
+	return nil
 }
@@ -1,19 +1,42 @@
 package shippers
 
 import (
-	"github.com/Sirupsen/logrus"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/fzzy/radix/redis"
 	radixurl "github.com/josegonzalez/go-radixurl"
 	"github.com/mike-a-davis/metricsd/structs"
 )
 
+import "github.com/Sirupsen/logrus"
 import "github.com/vaughan0/go-ini"
 
 // LogstashRedisShipper is an exported type that
 // allows shipping metrics to redis in logstash format
 type LogstashRedisShipper struct {
-	enabled bool
-	list    string
-	url     string
+	enabled   bool
+	mode      string
+	key       string
+	maxLength int
+	url       string
+	client    *redis.Client
+	mu        sync.Mutex
+	section   string
+}
+
+// the setting holding the key to write to in each mode
+var redisKeySettings = map[string]string{
+	"list":    "list",
+	"publish": "channel",
+	"stream":  "stream",
+}
+
+func init() {
+	Register("LogstashRedisShipper", func(section string) ShipperInterface {
+		return &LogstashRedisShipper{section: section}
+	})
 }
 
 // Enabled allows checking whether the shipper is enabled or not
@@ -30,13 +53,24 @@ func (s *LogstashRedisShipper) State(state bool) {
 func (s *LogstashRedisShipper) Setup(conf ini.File) {
 	s.State(true)
 
-	if list, ok := conf.Get("LogstashRedisShipper", "list"); ok {
-		s.list = list
+	s.mode = "list"
+	if mode, ok := conf.Get(s.section, "mode"); ok {
+		if _, ok := redisKeySettings[mode]; ok {
+			s.mode = mode
+		} else {
+			logrus.Warning(fmt.Sprintf("%s: invalid mode %s, using list", s.section, mode))
+		}
+	}
+
+	if key, ok := conf.Get(s.section, redisKeySettings[s.mode]); ok {
+		s.key = key
 	} else {
-		s.list = "metricsd"
+		s.key = "metricsd"
 	}
 
-	if url, ok := conf.Get("LogstashRedisShipper", "url"); ok {
+	s.maxLength = getInt(conf, s.section, "max_length", 0)
+
+	if url, ok := conf.Get(s.section, "url"); ok {
 		s.url = url
 	} else {
 		s.url = "redis://127.0.0.1:6379/0"
@@ -45,55 +79,87 @@ func (s *LogstashRedisShipper) Setup(conf ini.File) {
 
 // Ship sends a list of MetricSlices to redis
 func (s *LogstashRedisShipper) Ship(logs structs.MetricSlice) error {
-	c, err := radixurl.ConnectToURL(s.url)
-	errHndlr(err)
-	defer c.Close()
+	var serialized []string
+	for _, item := range logs {
+		if data := item.ToJSON(); data != nil {
+			serialized = append(serialized, string(data))
+		}
+	}
+	if len(serialized) == 0 {
+		return nil
+	}
 
-	var list []string
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	for _, item := range logs {
-		serialized := item.ToJSON()
-		list = append(list, string(serialized))
+	if s.client == nil {
+		c, err := radixurl.ConnectToURL(s.url)
+		if err != nil {
+			return fmt.Errorf("redis error: %v", err)
+		}
+		s.client = c
 	}
 
-	length := len(logs)
-	if length == 10 {
-		r := c.Cmd("rpush", s.list, list[0], list[1], list[2], list[3], list[4], list[5], list[6], list[7], list[8], list[9])
-		errHndlr(r.Err)
-	} else if length == 9 {
-		r := c.Cmd("rpush", s.list, list[0], list[1], list[2], list[3], list[4], list[5], list[6], list[7], list[8])
-		errHndlr(r.Err)
-	} else if length == 8 {
-		r := c.Cmd("rpush", s.list, list[0], list[1], list[2], list[3], list[4], list[5], list[6], list[7])
-		errHndlr(r.Err)
-	} else if length == 7 {
-		r := c.Cmd("rpush", s.list, list[0], list[1], list[2], list[3], list[4], list[5], list[6])
-		errHndlr(r.Err)
-	} else if length == 6 {
-		r := c.Cmd("rpush", s.list, list[0], list[1], list[2], list[3], list[4], list[5])
-		errHndlr(r.Err)
-	} else if length == 5 {
-		r := c.Cmd("rpush", s.list, list[0], list[1], list[2], list[3], list[4])
-		errHndlr(r.Err)
-	} else if length == 4 {
-		r := c.Cmd("rpush", s.list, list[0], list[1], list[2], list[3])
-		errHndlr(r.Err)
-	} else if length == 3 {
-		r := c.Cmd("rpush", s.list, list[0], list[1], list[2])
-		errHndlr(r.Err)
-	} else if length == 2 {
-		r := c.Cmd("rpush", s.list, list[0], list[1])
-		errHndlr(r.Err)
-	} else if length == 1 {
-		r := c.Cmd("rpush", s.list, list[0])
-		errHndlr(r.Err)
+	// every command of the batch is sent before any reply is
+	// read, so a batch costs a single round trip
+	commands := 0
+	switch s.mode {
+	case "publish":
+		for _, data := range serialized {
+			s.client.Append("publish", s.key, data)
+			commands++
+		}
+	case "stream":
+		for _, data := range serialized {
+			if s.maxLength > 0 {
+				s.client.Append("xadd", s.key, "maxlen", "~", strconv.Itoa(s.maxLength), "*", "message", data)
+			} else {
+				s.client.Append("xadd", s.key, "*", "message", data)
+			}
+			commands++
+		}
+	default:
+		args := []interface{}{s.key}
+		for _, data := range serialized {
+			args = append(args, data)
+		}
+		s.client.Append("rpush", args...)
+		commands++
+
+		// keep only the newest entries, so that a stalled
+		// consumer cannot fill up redis
+		if s.maxLength > 0 {
+			s.client.Append("ltrim", s.key, strconv.Itoa(-s.maxLength), "-1")
+			commands++
+		}
+	}
+
+	var err error
+	for i := 0; i < commands; i++ {
+		if r := s.client.GetReply(); r.Err != nil && err == nil {
+			err = r.Err
+		}
+	}
+	if err != nil {
+		// the connection may be broken, or out of step with the
+		// replies, so a new one is made for the next batch
+		s.client.Close()
+		s.client = nil
+		return fmt.Errorf("redis error: %v", err)
 	}
 
 	return nil
 }
 
-func errHndlr(err error) {
-	if err != nil {
-		logrus.Fatal("redis error: ", err)
+// Close closes the connection to redis
+func (s *LogstashRedisShipper) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == nil {
+		return nil
 	}
+	err := s.client.Close()
+	s.client = nil
+	return err
 }
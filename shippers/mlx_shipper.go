@@ -2,10 +2,14 @@ package shippers
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/mike-a-davis/metricsd/structs"
 	"github.com/vaughan0/go-ini"
 )
@@ -16,6 +20,15 @@ type MlxShipper struct {
 	enabled bool
 	debug   bool
 	url     string
+	batch   string
+	client  *http.Client
+	section string
+}
+
+func init() {
+	Register("MlxShipper", func(section string) ShipperInterface {
+		return &MlxShipper{section: section}
+	})
 }
 
 // Enabled allows checking whether the shipper is enabled or not
@@ -32,7 +45,7 @@ func (s *MlxShipper) State(state bool) {
 func (s *MlxShipper) Setup(conf ini.File) {
 	s.State(true)
 
-	useDebug, ok := conf.Get("MlxShipper", "debug")
+	useDebug, ok := conf.Get(s.section, "debug")
 	if ok && useDebug == "true" {
 		s.debug = true
 	} else {
@@ -40,43 +53,112 @@ func (s *MlxShipper) Setup(conf ini.File) {
 	}
 
 	s.url = "http://127.0.0.1:8888/udm"
-	useMlxURL, ok := conf.Get("MlxShipper", "url")
+	useMlxURL, ok := conf.Get(s.section, "url")
 	if ok {
 		s.url = useMlxURL
 	}
+
+	s.batch = "none"
+	if batch, ok := conf.Get(s.section, "batch"); ok {
+		if batch == "none" || batch == "array" || batch == "ndjson" {
+			s.batch = batch
+		} else {
+			logrus.Warning(fmt.Sprintf("%s: invalid batch %s, using none", s.section, batch))
+		}
+	}
+
+	// a single client keeps connections to the endpoint alive
+	// between requests
+	timeout := time.Duration(getInt(conf, s.section, "timeout", 10)) * time.Second
+	s.client = &http.Client{Timeout: timeout}
 }
 
 // Ship sends a list of MetricSlices to Mlx
 func (s *MlxShipper) Ship(logs structs.MetricSlice) error {
-
-	for _, item := range logs {
-		mlxMetric := item.ToJSON()
-		if s.debug {
-			fmt.Printf("%s\n", string(mlxMetric))
+	switch s.batch {
+	case "array":
+		var docs []map[string]interface{}
+		for _, item := range logs {
+			docs = append(docs, item.ToMap())
 		}
-
-		jsonStr := []byte(mlxMetric)
-		req, err := http.NewRequest("POST", s.url, bytes.NewBuffer(jsonStr))
-		req.Header.Set("Content-Type", "application/json")
-		if s.debug {
-			fmt.Println(req)
+		if len(docs) == 0 {
+			return nil
 		}
-		client := &http.Client{}
-		resp, err := client.Do(req)
+		body, err := json.Marshal(docs)
 		if err != nil {
-			panic(err)
+			return &PermanentError{fmt.Errorf("Failed to marshal metrics to JSON, %v", err)}
 		}
-		defer resp.Body.Close()
-
-		if s.debug {
-			fmt.Println("response Status:", resp.Status)
-			fmt.Println("response Headers:", resp.Header)
+		return s.post(body, "application/json")
+	case "ndjson":
+		var lines []string
+		for _, item := range logs {
+			if mlxMetric := item.ToJSON(); mlxMetric != nil {
+				lines = append(lines, string(mlxMetric))
+			}
 		}
-		body, _ := ioutil.ReadAll(resp.Body)
-		if s.debug {
-			fmt.Println("response Body:", string(body))
+		if len(lines) == 0 {
+			return nil
 		}
+		return s.post([]byte(strings.Join(lines, "\n")+"\n"), "application/x-ndjson")
+	}
+
+	return shipEach(s.section, logs, func(item *structs.Metric) error {
+		mlxMetric := item.ToJSON()
+		if mlxMetric == nil {
+			return nil
+		}
+		return s.post(mlxMetric, "application/json")
+	})
+}
+
+// post sends a request body, returning a PermanentError for
+// responses that mean sending it again would not help
+func (s *MlxShipper) post(body []byte, contentType string) error {
+	if s.debug {
+		fmt.Printf("%s\n", string(body))
+	}
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.debug {
+		fmt.Println(req)
 	}
 
-	return nil
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if s.debug {
+		fmt.Println("response Status:", resp.Status)
+		fmt.Println("response Headers:", resp.Header)
+	}
+	response, _ := ioutil.ReadAll(resp.Body)
+	if s.debug {
+		fmt.Println("response Body:", string(response))
+	}
+
+	return classifyStatus(resp.StatusCode, response)
+}
+
+// classifyStatus turns a non-2xx status into an error. Client
+// errors are permanent, except for timeouts and rate limiting
+// which, like server errors, may succeed on a later attempt.
+func classifyStatus(status int, body []byte) error {
+	if status >= 200 && status < 300 {
+		return nil
+	}
+
+	if len(body) > 256 {
+		body = body[:256]
+	}
+	err := fmt.Errorf("request failed with status %d: %s", status, strings.TrimSpace(string(body)))
+	if status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests {
+		return &PermanentError{err}
+	}
+	return err
 }
@@ -0,0 +1,276 @@
+package shippers
+
+import "bufio"
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "net"
+import "net/http"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+import "github.com/mike-a-davis/metricsd/structs"
+import "github.com/Sirupsen/logrus"
+import "github.com/vaughan0/go-ini"
+
+// OpenTSDBShipper is an exported type that
+// allows shipping metrics to opentsdb
+type OpenTSDBShipper struct {
+	enabled       bool
+	mode          string
+	url           string
+	prefix        string
+	excludeLabels map[string]bool
+	template      *structs.NameTemplate
+	timeout       time.Duration
+	client        *http.Client
+	con           net.Conn
+	mu            sync.Mutex
+	section       string
+}
+
+type openTSDBDatapoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+func init() {
+	Register("OpenTSDBShipper", func(section string) ShipperInterface {
+		return &OpenTSDBShipper{section: section}
+	})
+}
+
+// Enabled allows checking whether the shipper is enabled or not
+func (s *OpenTSDBShipper) Enabled() bool {
+	return s.enabled
+}
+
+// State allows setting the enabled state of the shipper
+func (s *OpenTSDBShipper) State(state bool) {
+	s.enabled = state
+}
+
+// Setup configures the shipper
+func (s *OpenTSDBShipper) Setup(conf ini.File) {
+	s.State(true)
+
+	s.mode = "telnet"
+	if mode, ok := conf.Get(s.section, "mode"); ok {
+		if mode == "telnet" || mode == "http" {
+			s.mode = mode
+		} else {
+			logrus.Warning(fmt.Sprintf("%s: invalid mode %s, using telnet", s.section, mode))
+		}
+	}
+
+	s.url = "127.0.0.1:4242"
+	if s.mode == "http" {
+		s.url = "http://127.0.0.1:4242"
+	}
+	if address, ok := conf.Get(s.section, "url"); ok {
+		s.url = strings.TrimRight(address, "/")
+		if s.mode == "telnet" {
+			s.url = strings.TrimPrefix(s.url, "tcp://")
+		}
+	}
+
+	if prefix, ok := conf.Get(s.section, "prefix"); ok {
+		s.prefix = fmt.Sprintf("%s.", prefix)
+	}
+
+	s.template = getTemplate(conf, s.section)
+
+	s.excludeLabels = getLabelSet(conf, s.section)
+
+	s.timeout = time.Duration(getInt(conf, s.section, "timeout", 10)) * time.Second
+	s.client = &http.Client{Timeout: s.timeout}
+}
+
+// Ship sends a list of MetricSlices to opentsdb
+func (s *OpenTSDBShipper) Ship(logs structs.MetricSlice) error {
+	var datapoints []*openTSDBDatapoint
+	for _, item := range logs {
+		value, ok := item.Float()
+		if !ok {
+			logrus.Warning(fmt.Sprintf("%s: dropping %s.%s, opentsdb only accepts numeric values", s.section, item.From, item.Name))
+			continue
+		}
+		datapoints = append(datapoints, &openTSDBDatapoint{
+			Metric:    s.metricName(item),
+			Timestamp: item.Timestamp.Unix(),
+			Value:     value,
+			Tags:      s.tags(item),
+		})
+	}
+	if len(datapoints) == 0 {
+		return nil
+	}
+
+	if s.mode == "http" {
+		return s.post(datapoints)
+	}
+	return s.put(datapoints)
+}
+
+// Close closes the telnet connection
+func (s *OpenTSDBShipper) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.con == nil {
+		return nil
+	}
+	err := s.con.Close()
+	s.con = nil
+	return err
+}
+
+// put writes datapoints as put lines over the telnet connection,
+// which is kept open between batches
+func (s *OpenTSDBShipper) put(datapoints []*openTSDBDatapoint) error {
+	var buf bytes.Buffer
+	for _, datapoint := range datapoints {
+		fmt.Fprintf(&buf, "put %s %d %s", datapoint.Metric, datapoint.Timestamp, strconv.FormatFloat(datapoint.Value, 'f', -1, 64))
+
+		var keys []string
+		for k := range datapoint.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&buf, " %s=%s", k, datapoint.Tags[k])
+		}
+		buf.WriteByte('\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.con == nil {
+		con, err := net.DialTimeout("tcp", s.url, 1*time.Second)
+		if err != nil {
+			logrus.Warning(fmt.Sprintf("%s: connecting to opentsdb failed with err: %s", s.section, err))
+			return err
+		}
+		s.con = con
+		go s.readErrors(con)
+	}
+
+	s.con.SetWriteDeadline(time.Now().Add(s.timeout))
+	if _, err := s.con.Write(buf.Bytes()); err != nil {
+		s.con.Close()
+		s.con = nil
+		return fmt.Errorf("writing to opentsdb failed with err: %s", err)
+	}
+	return nil
+}
+
+// readErrors logs the errors opentsdb writes back on the telnet
+// connection for lines it rejects, until the connection is closed
+func (s *OpenTSDBShipper) readErrors(con net.Conn) {
+	scanner := bufio.NewScanner(con)
+	for scanner.Scan() {
+		logrus.Warning(fmt.Sprintf("%s: opentsdb rejected a datapoint: %s", s.section, scanner.Text()))
+	}
+}
+
+// post sends datapoints to the http api, asking for the details
+// of every datapoint that could not be stored
+func (s *OpenTSDBShipper) post(datapoints []*openTSDBDatapoint) error {
+	body, err := json.Marshal(datapoints)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal datapoints to JSON, %v", err)
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/put?details", s.url), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to make request, %v", err)
+	}
+	defer resp.Body.Close()
+	response, _ := ioutil.ReadAll(resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusBadRequest:
+		// with ?details opentsdb stores the valid datapoints
+		// and lists the invalid ones, which are only logged
+		s.logErrors(response)
+		return nil
+	}
+	return fmt.Errorf("writing to opentsdb failed with status: %d", resp.StatusCode)
+}
+
+func (s *OpenTSDBShipper) logErrors(body []byte) {
+	var details struct {
+		Failed int `json:"failed"`
+		Errors []struct {
+			Datapoint openTSDBDatapoint `json:"datapoint"`
+			Error     string            `json:"error"`
+		} `json:"errors"`
+	}
+
+	if err := json.Unmarshal(body, &details); err != nil || len(details.Errors) == 0 {
+		logrus.Warning(fmt.Sprintf("%s: opentsdb rejected the batch: %s", s.section, strings.TrimSpace(string(body))))
+		return
+	}
+
+	for _, e := range details.Errors {
+		logrus.Warning(fmt.Sprintf("%s: opentsdb rejected %s: %s", s.section, e.Datapoint.Metric, e.Error))
+	}
+}
+
+func (s *OpenTSDBShipper) metricName(item *structs.Metric) string {
+	if key, ok := item.RenderTemplate(s.template, s.prefix); ok {
+		return openTSDBName(key)
+	}
+
+	path := item.From
+	if item.Path != "" {
+		path = item.Path
+	}
+	return openTSDBName(fmt.Sprintf("%s%s.%s", s.prefix, path, item.Name))
+}
+
+// tags returns the host and every Data field as tags. opentsdb
+// requires at least one tag, which the host guarantees.
+func (s *OpenTSDBShipper) tags(item *structs.Metric) map[string]string {
+	tags := map[string]string{"host": openTSDBName(item.Host)}
+	for k, v := range item.Data {
+		if s.excludeLabels[k] || v == nil {
+			continue
+		}
+		if value := openTSDBName(fmt.Sprintf("%v", v)); value != "" {
+			tags[openTSDBName(k)] = value
+		}
+	}
+	return tags
+}
+
+// openTSDBName replaces every character that opentsdb does not
+// allow in metric names and tags
+func openTSDBName(name string) string {
+	var buf bytes.Buffer
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			buf.WriteRune(r)
+		case r == '-', r == '_', r == '.', r == '/':
+			buf.WriteRune(r)
+		default:
+			buf.WriteRune('_')
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,238 @@
+package shippers
+
+import "bytes"
+import "fmt"
+import "net"
+import "net/http"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+import "github.com/mike-a-davis/metricsd/structs"
+import "github.com/Sirupsen/logrus"
+import "github.com/vaughan0/go-ini"
+
+// PrometheusShipper is an exported type that
+// allows prometheus to scrape the latest metrics
+type PrometheusShipper struct {
+	enabled       bool
+	listen        string
+	path          string
+	prefix        string
+	staleness     time.Duration
+	excludeLabels map[string]bool
+	series        map[string]*prometheusSeries
+	server        *http.Server
+	mu            sync.Mutex
+	section       string
+}
+
+type prometheusSeries struct {
+	name       string
+	labels     string
+	metricType string
+	value      float64
+	updated    time.Time
+}
+
+func init() {
+	Register("PrometheusShipper", func(section string) ShipperInterface {
+		return &PrometheusShipper{section: section}
+	})
+}
+
+// Enabled allows checking whether the shipper is enabled or not
+func (s *PrometheusShipper) Enabled() bool {
+	return s.enabled
+}
+
+// State allows setting the enabled state of the shipper
+func (s *PrometheusShipper) State(state bool) {
+	s.enabled = state
+}
+
+// Setup configures the shipper and starts listening for scrapes
+func (s *PrometheusShipper) Setup(conf ini.File) {
+	s.State(true)
+	s.series = make(map[string]*prometheusSeries)
+
+	s.listen = ":9103"
+	if listen, ok := conf.Get(s.section, "listen"); ok {
+		s.listen = listen
+	}
+
+	s.path = "/metrics"
+	if path, ok := conf.Get(s.section, "path"); ok {
+		s.path = path
+	}
+
+	if prefix, ok := conf.Get(s.section, "prefix"); ok {
+		s.prefix = fmt.Sprintf("%s_", prefix)
+	}
+
+	s.staleness = time.Duration(getInt(conf, s.section, "staleness", 300)) * time.Second
+
+	s.excludeLabels = getLabelSet(conf, s.section)
+
+	listener, err := net.Listen("tcp", s.listen)
+	if err != nil {
+		logrus.Warning(fmt.Sprintf("%s: listening on %s failed: %s", s.section, s.listen, err))
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(s.path, s.serve)
+	s.server = &http.Server{Handler: mux}
+	go s.server.Serve(listener)
+}
+
+// Ship stores the latest value of every metric for the next scrape
+func (s *PrometheusShipper) Ship(logs structs.MetricSlice) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, item := range logs {
+		value, ok := item.Float()
+		if !ok {
+			continue
+		}
+
+		name := s.metricName(item)
+		labels := s.labels(item)
+		key := name + labels
+		s.series[key] = &prometheusSeries{
+			name:       name,
+			labels:     labels,
+			metricType: prometheusType(item.MetricType),
+			value:      value,
+			updated:    item.Timestamp,
+		}
+	}
+
+	s.expire()
+	return nil
+}
+
+// Close stops listening for scrapes
+func (s *PrometheusShipper) Close() error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Close()
+}
+
+func (s *PrometheusShipper) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(s.render())
+}
+
+// render writes every live series in the text exposition
+// format, grouped by metric name under a single TYPE line
+func (s *PrometheusShipper) render() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+
+	var list []*prometheusSeries
+	for _, series := range s.series {
+		list = append(list, series)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].name != list[j].name {
+			return list[i].name < list[j].name
+		}
+		return list[i].labels < list[j].labels
+	})
+
+	var buf bytes.Buffer
+	previous := ""
+	for _, series := range list {
+		if series.name != previous {
+			fmt.Fprintf(&buf, "# TYPE %s %s\n", series.name, series.metricType)
+			previous = series.name
+		}
+		fmt.Fprintf(&buf, "%s%s %v\n", series.name, series.labels, series.value)
+	}
+	return buf.Bytes()
+}
+
+// expire drops series that have not been reported within the
+// staleness window, and must be called with the series locked
+func (s *PrometheusShipper) expire() {
+	if s.staleness <= 0 {
+		return
+	}
+
+	cutoff := time.Now().Add(-s.staleness)
+	for key, series := range s.series {
+		if series.updated.Before(cutoff) {
+			delete(s.series, key)
+		}
+	}
+}
+
+func (s *PrometheusShipper) metricName(item *structs.Metric) string {
+	path := item.From
+	if item.Path != "" {
+		path = item.Path
+	}
+	return prometheusName(fmt.Sprintf("%s%s_%s", s.prefix, path, item.Name), true)
+}
+
+// labels renders the host and every Data and Tags field as a
+// sorted label set, so that the same series always gets the same key
+func (s *PrometheusShipper) labels(item *structs.Metric) string {
+	values := map[string]string{"host": item.Host}
+	for _, fields := range []structs.FieldsMap{item.Data, item.Tags} {
+		for k, v := range fields {
+			if s.excludeLabels[k] || v == nil {
+				continue
+			}
+			values[prometheusName(k, false)] = fmt.Sprintf("%v", v)
+		}
+	}
+
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", k, prometheusLabelEscaper.Replace(values[k])))
+	}
+	return fmt.Sprintf("{%s}", strings.Join(pairs, ","))
+}
+
+var prometheusLabelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// prometheusName replaces every character that is not allowed in
+// a metric name, or in a label name which may not contain colons
+func prometheusName(name string, allowColon bool) string {
+	var buf bytes.Buffer
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+			buf.WriteRune(r)
+		case r >= '0' && r <= '9' && i > 0:
+			buf.WriteRune(r)
+		case r == ':' && allowColon:
+			buf.WriteRune(r)
+		default:
+			buf.WriteRune('_')
+		}
+	}
+	return buf.String()
+}
+
+func prometheusType(metricType string) string {
+	switch metricType {
+	case "gauge":
+		return "gauge"
+	case "rate":
+		return "counter"
+	}
+	return "untyped"
+}
@@ -0,0 +1,44 @@
+package shippers
+
+import "fmt"
+import "sync"
+
+// Factory is an exported type that builds a new,
+// unconfigured shipper for the given config section
+type Factory func(section string) ShipperInterface
+
+var registry = make(map[string]Factory)
+var registryMu sync.RWMutex
+
+// Register makes a shipper available under name. It is meant to be
+// called from init and panics if the name is already taken.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("shipper %s registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// Registered allows checking whether a shipper exists under name
+func Registered(name string) bool {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	_, ok := registry[name]
+	return ok
+}
+
+// New builds the shipper registered under name for a config section
+func New(name string, section string) (ShipperInterface, error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown shipper %s", name)
+	}
+	return factory(section), nil
+}
@@ -1,5 +1,8 @@
 package shippers
 
+import "fmt"
+import "github.com/Sirupsen/logrus"
+import "github.com/mike-a-davis/metricsd/stats"
 import "github.com/mike-a-davis/metricsd/structs"
 import "github.com/vaughan0/go-ini"
 
@@ -11,3 +14,51 @@ type ShipperInterface interface {
 	Ship(structs.MetricSlice) error
 	State(bool)
 }
+
+// Closer is an exported type that is implemented by
+// shippers holding connections that need closing on shutdown
+type Closer interface {
+	Close() error
+}
+
+// PermanentError is an exported type that is returned by
+// shippers for batches that would fail the same way if sent
+// again, which are then dropped instead of retried
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// PartialError is an exported type that is returned by shippers
+// that delivered part of a batch. Only the metrics in Remaining
+// are retried, so those already accepted are not sent twice.
+type PartialError struct {
+	Err       error
+	Remaining structs.MetricSlice
+}
+
+func (e *PartialError) Error() string {
+	return e.Err.Error()
+}
+
+// shipEach sends the metrics of a batch one at a time. A metric
+// rejected with a PermanentError is dropped and the rest of the
+// batch is still sent, while any other error stops the batch and
+// returns the metrics not yet accepted in a PartialError.
+func shipEach(section string, logs structs.MetricSlice, send func(*structs.Metric) error) error {
+	for i, item := range logs {
+		err := send(item)
+		if _, ok := err.(*PermanentError); ok {
+			logrus.Warning(fmt.Sprintf("%s: dropping metric: %s", section, err))
+			stats.RecordDrop(section, 1)
+			continue
+		}
+		if err != nil {
+			return &PartialError{Err: err, Remaining: logs[i:]}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+package shippers
+
+import "bytes"
+import "encoding/binary"
+import "encoding/json"
+import "fmt"
+import "hash/crc32"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "github.com/mike-a-davis/metricsd/structs"
+import "github.com/Sirupsen/logrus"
+
+const (
+	spoolMagic           = uint32(0x6d736431)
+	spoolHeaderSize      = 12
+	spoolSegmentSuffix   = ".seg"
+	minSpoolSegmentBytes = 64 * 1024
+)
+
+// Spool is an exported type that persists undeliverable
+// batches to segment files on disk, so they survive both
+// long outages and restarts
+//
+// Every record is framed by a magic number, its length and a
+// crc32 checksum, which lets a reader skip damaged records and
+// resynchronize on the next intact one.
+type Spool struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+	size         int64
+	sequence     uint64
+	current      *os.File
+	currentSize  int64
+	mu           sync.Mutex
+}
+
+// OpenSpool opens the spool in dir, creating it if necessary
+func OpenSpool(dir string, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: maxBytes / 8,
+	}
+	if s.segmentBytes < minSpoolSegmentBytes {
+		s.segmentBytes = minSpoolSegmentBytes
+	}
+
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		if info, err := os.Stat(s.path(segment)); err == nil {
+			s.size += info.Size()
+		}
+		s.sequence = segment
+	}
+
+	return s, nil
+}
+
+// Empty returns true if there is nothing left to replay
+func (s *Spool) Empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size == 0
+}
+
+// Write appends a batch to the newest segment, evicting the oldest
+// segments once the spool grows beyond its size limit
+func (s *Spool) Write(logs structs.MetricSlice) error {
+	payload, err := json.Marshal(logs)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal batch to JSON, %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current == nil || s.currentSize >= s.segmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	record := encodeRecord(payload)
+	n, err := s.current.Write(record)
+	s.currentSize += int64(n)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	s.evict()
+	return nil
+}
+
+// Replay ships every spooled batch in the order it was written. It
+// stops at the first failure, keeping that batch and everything after
+// it for the next attempt.
+//
+// The segment being written is sealed first, so batches spooled while
+// replaying go to a new segment that is left for the next replay
+// rather than being removed or rewritten underneath the writer.
+func (s *Spool) Replay(ship func(structs.MetricSlice) error) error {
+	s.mu.Lock()
+	s.closeCurrent()
+	limit := s.sequence + 1
+	s.mu.Unlock()
+
+	for {
+		s.mu.Lock()
+		segments, err := s.segments()
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if len(segments) == 0 || segments[0] >= limit {
+			return nil
+		}
+
+		segment := segments[0]
+		batches, skipped, err := readSegment(s.path(segment))
+		if err != nil {
+			return err
+		}
+		if skipped > 0 {
+			logrus.Warning(fmt.Sprintf("spool %s: skipped %d bytes of corrupt data in segment %d", s.dir, skipped, segment))
+		}
+
+		for i, batch := range batches {
+			if err := ship(batch); err != nil {
+				s.mu.Lock()
+				rewriteErr := s.rewrite(segment, batches[i:])
+				s.mu.Unlock()
+				if rewriteErr != nil {
+					logrus.Warning(fmt.Sprintf("spool %s: %s", s.dir, rewriteErr))
+				}
+				return err
+			}
+		}
+
+		s.mu.Lock()
+		s.remove(segment)
+		s.mu.Unlock()
+	}
+}
+
+// Close closes the segment currently being written
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeCurrent()
+}
+
+func (s *Spool) rotate() error {
+	s.closeCurrent()
+
+	s.sequence++
+	f, err := os.OpenFile(s.path(s.sequence), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.current = f
+	s.currentSize = 0
+	return nil
+}
+
+func (s *Spool) closeCurrent() error {
+	if s.current == nil {
+		return nil
+	}
+	err := s.current.Close()
+	s.current = nil
+	s.currentSize = 0
+	return err
+}
+
+func (s *Spool) evict() {
+	for s.size > s.maxBytes {
+		segments, err := s.segments()
+		if err != nil || len(segments) == 0 {
+			return
+		}
+		if len(segments) == 1 && s.current != nil {
+			// never throw away the segment that was just written to
+			return
+		}
+
+		logrus.Warning(fmt.Sprintf("spool %s: exceeded %d bytes, evicting segment %d", s.dir, s.maxBytes, segments[0]))
+		s.remove(segments[0])
+	}
+}
+
+func (s *Spool) remove(segment uint64) {
+	path := s.path(segment)
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if s.current != nil && segment == s.sequence {
+		s.closeCurrent()
+	}
+	if err := os.Remove(path); err == nil {
+		s.size -= info.Size()
+	}
+}
+
+// rewrite replaces a segment with the batches that still need to be
+// shipped, unless the segment was evicted in the meantime
+func (s *Spool) rewrite(segment uint64, batches []structs.MetricSlice) error {
+	path := s.path(segment)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, batch := range batches {
+		payload, err := json.Marshal(batch)
+		if err != nil {
+			return err
+		}
+		buf.Write(encodeRecord(payload))
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	s.size += int64(buf.Len()) - info.Size()
+	return nil
+}
+
+func (s *Spool) segments() ([]uint64, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, spoolSegmentSuffix) {
+			continue
+		}
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, sequence)
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (s *Spool) path(segment uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", segment, spoolSegmentSuffix))
+}
+
+func encodeRecord(payload []byte) []byte {
+	record := make([]byte, spoolHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], spoolMagic)
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[8:12], crc32.ChecksumIEEE(payload))
+	copy(record[spoolHeaderSize:], payload)
+	return record
+}
+
+// readSegment decodes every intact record of a segment file and
+// reports how many bytes had to be skipped to get past damaged ones
+func readSegment(path string) ([]structs.MetricSlice, int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var batches []structs.MetricSlice
+	skipped := 0
+	for len(data) > 0 {
+		if len(data) < spoolHeaderSize || binary.BigEndian.Uint32(data[0:4]) != spoolMagic {
+			next := resync(data)
+			skipped += next
+			data = data[next:]
+			continue
+		}
+
+		length := int(binary.BigEndian.Uint32(data[4:8]))
+		checksum := binary.BigEndian.Uint32(data[8:12])
+		if length > len(data)-spoolHeaderSize || crc32.ChecksumIEEE(data[spoolHeaderSize:spoolHeaderSize+length]) != checksum {
+			next := resync(data)
+			skipped += next
+			data = data[next:]
+			continue
+		}
+
+		var batch structs.MetricSlice
+		payload := data[spoolHeaderSize : spoolHeaderSize+length]
+		if err := json.Unmarshal(payload, &batch); err != nil {
+			skipped += spoolHeaderSize + length
+		} else {
+			batches = append(batches, batch)
+		}
+		data = data[spoolHeaderSize+length:]
+	}
+
+	return batches, skipped, nil
+}
+
+// resync returns the offset of the next record header after the
+// current position, or the length of data if there is none
+func resync(data []byte) int {
+	magic := make([]byte, 4)
+	binary.BigEndian.PutUint32(magic, spoolMagic)
+
+	if i := bytes.Index(data[1:], magic); i >= 0 {
+		return i + 1
+	}
+	return len(data)
+}
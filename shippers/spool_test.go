@@ -0,0 +1,137 @@
+package shippers
+
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sync"
+import "testing"
+import "time"
+import "github.com/mike-a-davis/metricsd/structs"
+
+func TestSpoolReplayWhileWriting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenSpool(dir, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// small segments, so that writes rotate while replaying
+	spool.segmentBytes = 512
+
+	const total = 2000
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < total; i++ {
+			if err := spool.Write(structs.MetricSlice{{Name: fmt.Sprintf("%d", i)}}); err != nil {
+				t.Error(err)
+			}
+			time.Sleep(time.Microsecond)
+		}
+	}()
+
+	shipped := map[string]int{}
+	ship := func(logs structs.MetricSlice) error {
+		for _, item := range logs {
+			shipped[item.Name]++
+		}
+		// give the writer time to append while a segment is replayed
+		time.Sleep(10 * time.Microsecond)
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		if err := spool.Replay(ship); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := spool.Replay(ship); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(shipped) != total {
+		t.Fatalf("shipped %d of %d batches", len(shipped), total)
+	}
+	for name, count := range shipped {
+		if count != 1 {
+			t.Fatalf("batch %s shipped %d times", name, count)
+		}
+	}
+	if !spool.Empty() {
+		t.Fatal("spool not empty after replaying everything")
+	}
+}
+
+func TestSpoolSkipsCorruptRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenSpool(dir, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"first", "second", "third"} {
+		if err := spool.Write(structs.MetricSlice{{Name: name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	spool.Close()
+
+	// damage the payload of the second record, and put garbage
+	// in front of the third
+	path := filepath.Join(dir, fmt.Sprintf("%020d%s", 1, spoolSegmentSuffix))
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := len(encodeRecord(mustMarshal(t, structs.MetricSlice{{Name: "first"}})))
+	second := len(encodeRecord(mustMarshal(t, structs.MetricSlice{{Name: "second"}})))
+	data[first+spoolHeaderSize+2] ^= 0xff
+	corrupted := append(append(append([]byte{}, data[:first+second]...), []byte("garbage")...), data[first+second:]...)
+	if err := ioutil.WriteFile(path, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	err = spool.Replay(func(logs structs.MetricSlice) error {
+		for _, item := range logs {
+			names = append(names, item.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != 2 || names[0] != "first" || names[1] != "third" {
+		t.Fatalf("replayed %v, want [first third]", names)
+	}
+}
+
+func mustMarshal(t *testing.T, logs structs.MetricSlice) []byte {
+	data, err := json.Marshal(logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
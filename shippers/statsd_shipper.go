@@ -0,0 +1,249 @@
+package shippers
+
+import "bytes"
+import "fmt"
+import "net"
+import "net/url"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+import "github.com/mike-a-davis/metricsd/structs"
+import "github.com/Sirupsen/logrus"
+import "github.com/vaughan0/go-ini"
+
+// StatsdShipper is an exported type that
+// allows shipping metrics to statsd over datagrams
+type StatsdShipper struct {
+	enabled       bool
+	network       string
+	address       string
+	prefix        string
+	dogstatsd     bool
+	packetSize    int
+	template      *structs.NameTemplate
+	excludeLabels map[string]bool
+	counters      map[string]float64
+	con           net.Conn
+	mu            sync.Mutex
+	section       string
+}
+
+var statsdNameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", " ", "_", "\n", "_")
+var statsdTagReplacer = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+var statsdTagKeyReplacer = strings.NewReplacer(":", "_", ",", "_", "|", "_", "#", "_", "\n", "_")
+
+func init() {
+	Register("StatsdShipper", func(section string) ShipperInterface {
+		return &StatsdShipper{section: section}
+	})
+}
+
+// Enabled allows checking whether the shipper is enabled or not
+func (s *StatsdShipper) Enabled() bool {
+	return s.enabled
+}
+
+// State allows setting the enabled state of the shipper
+func (s *StatsdShipper) State(state bool) {
+	s.enabled = state
+}
+
+// Setup configures the shipper
+func (s *StatsdShipper) Setup(conf ini.File) {
+	s.State(true)
+
+	s.network, s.address = "udp", "127.0.0.1:8125"
+	if useStatsdURL, ok := conf.Get(s.section, "url"); ok {
+		statsdURL, err := url.Parse(useStatsdURL)
+		switch {
+		case err != nil:
+			logrus.Warning(fmt.Sprintf("%s: error parsing statsd url: %s", s.section, err))
+			logrus.Warning(fmt.Sprintf("%s: using default udp://127.0.0.1:8125 for statsd url", s.section))
+		case statsdURL.Scheme == "udp":
+			s.address = statsdURL.Host
+			if statsdURL.Port() == "" {
+				s.address = net.JoinHostPort(statsdURL.Hostname(), "8125")
+			}
+		case statsdURL.Scheme == "unix" || statsdURL.Scheme == "unixgram":
+			s.network, s.address = "unixgram", statsdURL.Path
+		default:
+			logrus.Warning(fmt.Sprintf("%s: unsupported statsd url scheme %s", s.section, statsdURL.Scheme))
+			logrus.Warning(fmt.Sprintf("%s: using default udp://127.0.0.1:8125 for statsd url", s.section))
+		}
+	}
+
+	if prefix, ok := conf.Get(s.section, "prefix"); ok {
+		s.prefix = fmt.Sprintf("%s.", prefix)
+	}
+
+	s.template = getTemplate(conf, s.section)
+
+	useDogstatsd, ok := conf.Get(s.section, "dogstatsd")
+	s.dogstatsd = ok && useDogstatsd == "true"
+
+	// 1432 bytes fits in a single ethernet frame once the
+	// IP and UDP headers have been added
+	s.packetSize = getInt(conf, s.section, "packet_size", 1432)
+
+	s.counters = map[string]float64{}
+
+	s.excludeLabels = getLabelSet(conf, s.section)
+}
+
+// Ship sends a list of MetricSlices to statsd, packing as many
+// lines as fit into each datagram
+func (s *StatsdShipper) Ship(logs structs.MetricSlice) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// counter totals are only remembered once they have been
+	// sent, so that a retried batch sends the same increments
+	counters := map[string]float64{}
+
+	var packets [][]byte
+	var buf bytes.Buffer
+	for _, item := range logs {
+		line, ok := s.line(item, counters)
+		if !ok {
+			continue
+		}
+		if buf.Len() > 0 && buf.Len()+1+len(line) > s.packetSize {
+			packets = append(packets, append([]byte(nil), buf.Bytes()...))
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		packets = append(packets, buf.Bytes())
+	}
+	if len(packets) == 0 {
+		s.remember(counters)
+		return nil
+	}
+
+	if s.con == nil {
+		con, err := net.DialTimeout(s.network, s.address, 1*time.Second)
+		if err != nil {
+			logrus.Warning(fmt.Sprintf("%s: connecting to statsd failed with err: %s", s.section, err))
+			return err
+		}
+		s.con = con
+	}
+
+	for _, packet := range packets {
+		if _, err := s.con.Write(packet); err != nil {
+			s.con.Close()
+			s.con = nil
+			return fmt.Errorf("writing to statsd failed with err: %s", err)
+		}
+	}
+	s.remember(counters)
+	return nil
+}
+
+func (s *StatsdShipper) remember(counters map[string]float64) {
+	for key, value := range counters {
+		s.counters[key] = value
+	}
+}
+
+// Close closes the statsd socket
+func (s *StatsdShipper) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.con == nil {
+		return nil
+	}
+	err := s.con.Close()
+	s.con = nil
+	return err
+}
+
+// line renders a metric in the statsd format. Metrics that are
+// not numeric are skipped.
+//
+// Rates are running totals while statsd adds up every counter
+// value it receives, so counters are sent as the increase since
+// the total last seen for the series. The first total of a series
+// and totals lower than the last, after a reset, only set the
+// baseline. New totals are collected in counters.
+func (s *StatsdShipper) line(item *structs.Metric, counters map[string]float64) (string, bool) {
+	value, ok := item.Float()
+	if !ok {
+		return "", false
+	}
+
+	path := item.From
+	if item.Path != "" {
+		path = item.Path
+	}
+
+	// with dogstatsd the host is sent as a tag rather than
+	// as part of the name, as with the graphite shipper
+	var name, tags string
+	if s.dogstatsd {
+		name = fmt.Sprintf("%s%s.%s", s.prefix, path, item.Name)
+		tags = s.tags(item)
+	} else {
+		name = fmt.Sprintf("%s%s.%s.%s", s.prefix, item.Host, item.KeyPath(), item.Name)
+	}
+	if key, ok := item.RenderTemplate(s.template, s.prefix); ok {
+		name = key
+	}
+	name = statsdNameReplacer.Replace(name)
+
+	statsdType := "g"
+	if item.MetricType == "rate" {
+		statsdType = "c"
+
+		key := name + tags
+		last, seen := counters[key]
+		if !seen {
+			last, seen = s.counters[key]
+		}
+		counters[key] = value
+		if !seen || value < last {
+			return "", false
+		}
+		value -= last
+	}
+
+	formatted := strconv.FormatFloat(value, 'f', -1, 64)
+	line := fmt.Sprintf("%s:%s|%s%s", name, formatted, statsdType, tags)
+
+	// a signed gauge value is read as a change to the current
+	// value, so negative gauges are reset to zero first, in the
+	// same datagram so the two lines cannot be reordered
+	if statsdType == "g" && value < 0 {
+		line = fmt.Sprintf("%s:0|g%s\n%s", name, tags, line)
+	}
+	return line, true
+}
+
+func (s *StatsdShipper) tags(item *structs.Metric) string {
+	values := map[string]string{"host": item.Host}
+	for k, v := range item.Data {
+		if s.excludeLabels[k] || v == nil {
+			continue
+		}
+		values[k] = fmt.Sprintf("%v", v)
+	}
+
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s:%s", statsdTagKeyReplacer.Replace(k), statsdTagReplacer.Replace(values[k])))
+	}
+	return fmt.Sprintf("|#%s", strings.Join(pairs, ","))
+}
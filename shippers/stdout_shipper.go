@@ -10,6 +10,12 @@ type StdoutShipper struct {
 	enabled bool
 }
 
+func init() {
+	Register("StdoutShipper", func(_ string) ShipperInterface {
+		return &StdoutShipper{}
+	})
+}
+
 // Enabled allows checking whether the shipper is enabled or not
 func (s *StdoutShipper) Enabled() bool {
 	return s.enabled
@@ -0,0 +1,294 @@
+package shippers
+
+import "bytes"
+import "fmt"
+import "net"
+import "net/url"
+import "os"
+import "sort"
+import "strings"
+import "sync"
+import "text/template"
+import "time"
+import "github.com/mike-a-davis/metricsd/structs"
+import "github.com/Sirupsen/logrus"
+import "github.com/vaughan0/go-ini"
+
+// SyslogShipper is an exported type that
+// allows shipping metrics to syslog in RFC 5424 format
+type SyslogShipper struct {
+	enabled  bool
+	network  string
+	address  string
+	facility int
+	severity int
+	appName  string
+	sdID     string
+	message  *template.Template
+	timeout  time.Duration
+	con      net.Conn
+	mu       sync.Mutex
+	section  string
+}
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3,
+	"auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3,
+	"warning": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+var syslogParamEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "]", "\\]")
+
+const syslogDefaultMessage = "{{.From}}.{{.Name}} {{.Value}}"
+
+func init() {
+	Register("SyslogShipper", func(section string) ShipperInterface {
+		return &SyslogShipper{section: section}
+	})
+}
+
+// Enabled allows checking whether the shipper is enabled or not
+func (s *SyslogShipper) Enabled() bool {
+	return s.enabled
+}
+
+// State allows setting the enabled state of the shipper
+func (s *SyslogShipper) State(state bool) {
+	s.enabled = state
+}
+
+// Setup configures the shipper
+func (s *SyslogShipper) Setup(conf ini.File) {
+	s.State(true)
+
+	s.network, s.address = "udp", "127.0.0.1:514"
+	if useSyslogURL, ok := conf.Get(s.section, "url"); ok {
+		syslogURL, err := url.Parse(useSyslogURL)
+		switch {
+		case err != nil:
+			logrus.Warning(fmt.Sprintf("%s: error parsing syslog url: %s", s.section, err))
+			logrus.Warning(fmt.Sprintf("%s: using default udp://127.0.0.1:514 for syslog url", s.section))
+		case syslogURL.Scheme == "udp" || syslogURL.Scheme == "tcp":
+			s.network, s.address = syslogURL.Scheme, syslogURL.Host
+			if syslogURL.Port() == "" {
+				s.address = net.JoinHostPort(syslogURL.Hostname(), "514")
+			}
+		case syslogURL.Scheme == "unix":
+			s.network, s.address = "unix", syslogURL.Path
+		default:
+			logrus.Warning(fmt.Sprintf("%s: unsupported syslog url scheme %s", s.section, syslogURL.Scheme))
+			logrus.Warning(fmt.Sprintf("%s: using default udp://127.0.0.1:514 for syslog url", s.section))
+		}
+	}
+
+	s.facility = syslogFacilities["local0"]
+	if facility, ok := conf.Get(s.section, "facility"); ok {
+		if f, ok := syslogFacilities[facility]; ok {
+			s.facility = f
+		} else {
+			logrus.Warning(fmt.Sprintf("%s: invalid facility %s, using local0", s.section, facility))
+		}
+	}
+
+	s.severity = syslogSeverities["info"]
+	if severity, ok := conf.Get(s.section, "severity"); ok {
+		if sev, ok := syslogSeverities[severity]; ok {
+			s.severity = sev
+		} else {
+			logrus.Warning(fmt.Sprintf("%s: invalid severity %s, using info", s.section, severity))
+		}
+	}
+
+	s.appName = "metricsd"
+	if appName, ok := conf.Get(s.section, "app_name"); ok {
+		s.appName = syslogHeaderField(appName, 48)
+	}
+
+	// 32473 is the enterprise number reserved for examples,
+	// and should be replaced by the one of the organization
+	s.sdID = "metric@32473"
+	if sdID, ok := conf.Get(s.section, "sd_id"); ok {
+		s.sdID = syslogParamName(sdID)
+	}
+
+	message := syslogDefaultMessage
+	if m, ok := conf.Get(s.section, "message"); ok {
+		message = m
+	}
+	var err error
+	s.message, err = template.New(s.section).Funcs(httpTemplateFuncs).Parse(message)
+	if err != nil {
+		logrus.Warning(fmt.Sprintf("%s: parsing message failed, using %s: %s", s.section, syslogDefaultMessage, err))
+		s.message = template.Must(template.New(s.section).Funcs(httpTemplateFuncs).Parse(syslogDefaultMessage))
+	}
+
+	s.timeout = time.Duration(getInt(conf, s.section, "timeout", 10)) * time.Second
+}
+
+// Ship sends every metric as its own syslog message
+func (s *SyslogShipper) Ship(logs structs.MetricSlice) error {
+	// sources holds the index in logs of the metric
+	// each message was rendered from
+	var messages [][]byte
+	var sources []int
+	for i, item := range logs {
+		message, err := s.format(item)
+		if err != nil {
+			logrus.Warning(fmt.Sprintf("%s: rendering message failed: %s", s.section, err))
+			continue
+		}
+		messages = append(messages, message)
+		sources = append(sources, i)
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.con == nil {
+		if err := s.connect(); err != nil {
+			logrus.Warning(fmt.Sprintf("%s: connecting to syslog failed with err: %s", s.section, err))
+			return err
+		}
+	}
+
+	s.con.SetWriteDeadline(time.Now().Add(s.timeout))
+	for i, message := range messages {
+		// stream transports need octet-counting framing, as
+		// messages may contain newlines
+		if s.network == "tcp" || s.network == "unix" {
+			message = append([]byte(fmt.Sprintf("%d ", len(message))), message...)
+		}
+		if _, err := s.con.Write(message); err != nil {
+			s.con.Close()
+			s.con = nil
+			// the messages before this one were delivered
+			return &PartialError{
+				Err:       fmt.Errorf("writing to syslog failed with err: %s", err),
+				Remaining: logs[sources[i]:],
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes the connection to syslog
+func (s *SyslogShipper) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.con == nil {
+		return nil
+	}
+	err := s.con.Close()
+	s.con = nil
+	return err
+}
+
+// connect opens the connection. Local sockets such as /dev/log
+// are usually datagram sockets, with stream ones as a fallback.
+// It must be called with the shipper locked.
+func (s *SyslogShipper) connect() error {
+	if s.network == "unix" || s.network == "unixgram" {
+		con, err := net.DialTimeout("unixgram", s.address, 1*time.Second)
+		if err == nil {
+			s.network, s.con = "unixgram", con
+			return nil
+		}
+		s.network = "unix"
+	}
+
+	con, err := net.DialTimeout(s.network, s.address, 1*time.Second)
+	if err != nil {
+		return err
+	}
+	s.con = con
+	return nil
+}
+
+// format renders a metric as an RFC 5424 message, with the
+// Data fields of the metric as structured data
+func (s *SyslogShipper) format(item *structs.Metric) ([]byte, error) {
+	var msg bytes.Buffer
+	if err := s.message.Execute(&msg, item); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s %d %s ",
+		s.facility*8+s.severity,
+		item.Timestamp.Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(item.Host, 255),
+		s.appName,
+		os.Getpid(),
+		syslogHeaderField(item.From, 32),
+	)
+
+	var keys []string
+	for k, v := range item.Data {
+		if v != nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	if len(keys) == 0 {
+		buf.WriteString("-")
+	} else {
+		fmt.Fprintf(&buf, "[%s", s.sdID)
+		for _, k := range keys {
+			fmt.Fprintf(&buf, " %s=\"%s\"", syslogParamName(k), syslogParamEscaper.Replace(fmt.Sprintf("%v", item.Data[k])))
+		}
+		buf.WriteString("]")
+	}
+
+	if msg.Len() > 0 {
+		buf.WriteString(" ")
+		buf.Write(msg.Bytes())
+	}
+	return buf.Bytes(), nil
+}
+
+// syslogHeaderField replaces anything but printable ascii in a
+// header field, which may not be empty and is capped in length
+func syslogHeaderField(value string, maxLength int) string {
+	var buf bytes.Buffer
+	for _, r := range value {
+		if r <= ' ' || r > '~' {
+			r = '_'
+		}
+		buf.WriteRune(r)
+	}
+	if buf.Len() == 0 {
+		return "-"
+	}
+	if buf.Len() > maxLength {
+		buf.Truncate(maxLength)
+	}
+	return buf.String()
+}
+
+// syslogParamName replaces the characters not allowed in
+// structured data names, which are at most 32 characters long
+func syslogParamName(name string) string {
+	var buf bytes.Buffer
+	for _, r := range name {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			r = '_'
+		}
+		buf.WriteRune(r)
+	}
+	if buf.Len() > 32 {
+		buf.Truncate(32)
+	}
+	return buf.String()
+}
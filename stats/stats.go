@@ -0,0 +1,132 @@
+package stats
+
+import "sync"
+import "time"
+
+// CollectorStats is an exported type that
+// holds the numbers recorded for a collector
+type CollectorStats struct {
+	Runs     int64
+	Errors   int64
+	Metrics  int
+	Duration time.Duration
+}
+
+// ShipperStats is an exported type that
+// holds the numbers recorded for a shipper
+type ShipperStats struct {
+	Batches    int64
+	Failures   int64
+	Dropped    int64
+	Spooled    int64
+	QueueDepth int
+	Oldest     time.Time
+	Latency    time.Duration
+}
+
+var mu sync.Mutex
+var collectors = make(map[string]*CollectorStats)
+var shippers = make(map[string]*ShipperStats)
+
+// RecordCollect records a single run of a collector
+func RecordCollect(name string, duration time.Duration, metrics int, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s, ok := collectors[name]
+	if !ok {
+		s = &CollectorStats{}
+		collectors[name] = s
+	}
+
+	s.Runs++
+	s.Metrics = metrics
+	s.Duration = duration
+	if err != nil {
+		s.Errors++
+	}
+}
+
+// RecordShip records a single attempt of a shipper to ship a batch
+func RecordShip(name string, latency time.Duration, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s := shipper(name)
+	s.Latency = latency
+	if err != nil {
+		s.Failures++
+	} else {
+		s.Batches++
+	}
+}
+
+// RecordQueue records how many batches a shipper has queued and
+// when the oldest of them was queued, which is zero if there is none
+func RecordQueue(name string, depth int, oldest time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s := shipper(name)
+	s.QueueDepth = depth
+	s.Oldest = oldest
+}
+
+// RecordDrop records metrics a shipper had to give up on
+func RecordDrop(name string, metrics int) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	shipper(name).Dropped += int64(metrics)
+}
+
+// RecordSpool records metrics a shipper wrote to its spool
+func RecordSpool(name string, metrics int) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	shipper(name).Spooled += int64(metrics)
+}
+
+// Forget drops everything recorded for a collector or shipper
+// that is no longer running
+func Forget(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	delete(collectors, name)
+	delete(shippers, name)
+}
+
+// Collectors returns a copy of the numbers recorded for every collector
+func Collectors() map[string]CollectorStats {
+	mu.Lock()
+	defer mu.Unlock()
+
+	snapshot := make(map[string]CollectorStats, len(collectors))
+	for name, s := range collectors {
+		snapshot[name] = *s
+	}
+	return snapshot
+}
+
+// Shippers returns a copy of the numbers recorded for every shipper
+func Shippers() map[string]ShipperStats {
+	mu.Lock()
+	defer mu.Unlock()
+
+	snapshot := make(map[string]ShipperStats, len(shippers))
+	for name, s := range shippers {
+		snapshot[name] = *s
+	}
+	return snapshot
+}
+
+func shipper(name string) *ShipperStats {
+	s, ok := shippers[name]
+	if !ok {
+		s = &ShipperStats{}
+		shippers[name] = s
+	}
+	return s
+}
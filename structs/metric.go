@@ -3,6 +3,8 @@ package structs
 import "encoding/json"
 import "fmt"
 import "os"
+import "strconv"
+import "strings"
 import "time"
 import "github.com/Sirupsen/logrus"
 import "github.com/vaughan0/go-ini"
@@ -21,6 +23,9 @@ type Metric struct {
 	TTL        int
 	Data       FieldsMap
 	Tags       FieldsMap
+	// Template is the naming template set on the collector
+	// the metric came from, if any
+	Template string
 }
 
 var Hostname string
@@ -62,6 +67,10 @@ func (m *Metric) Process(conf ini.File) {
 	if hostname, ok := conf.Get(m.Collector, "hostname"); ok {
 		m.Host = hostname
 	}
+
+	if template, ok := conf.Get(m.Collector, "template"); ok {
+		m.Template = template
+	}
 }
 
 func (m *Metric) ToMap() map[string]interface{} {
@@ -98,6 +107,47 @@ func (m *Metric) ToMap() map[string]interface{} {
 	return data
 }
 
+// Float returns the value of the metric as a float64, parsing
+// strings if necessary. It returns false for values that are
+// not numeric, such as nil.
+func (m *Metric) Float() (float64, bool) {
+	switch v := m.Value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
 func (m *Metric) ToJSON() []byte {
 	data := m.ToMap()
 
@@ -110,13 +160,44 @@ func (m *Metric) ToJSON() []byte {
 }
 
 func (m *Metric) ToGraphite(prefix string) (response string) {
+	return fmt.Sprintf("%s %v %d", m.GraphiteKey(prefix), m.Value, int32(m.Timestamp.Unix()))
+}
+
+// RenderTemplate returns the path of the metric built from the
+// template of its collector or, failing that, the given template.
+// It returns false when neither is set.
+func (m *Metric) RenderTemplate(template *NameTemplate, prefix string) (string, bool) {
+	if m.Template != "" {
+		if t, err := LookupNameTemplate(m.Template); err == nil {
+			template = t
+		}
+	}
+	if template == nil {
+		return "", false
+	}
+	return template.Render(m, strings.TrimSuffix(prefix, ".")), true
+}
+
+// KeyPath returns the path of the metric, followed by the instance
+// of the collector it came from, if any, so that instances of the
+// same collector do not share keys in shippers without tags
+func (m *Metric) KeyPath() string {
 	path := m.From
 	if m.Path != "" {
 		path = m.Path
 	}
-	key := fmt.Sprintf("%s.%s.%s", m.Host, path, m.Name)
+	if instance, ok := m.Data["instance"].(string); ok && instance != "" {
+		path = fmt.Sprintf("%s.%s", path, instance)
+	}
+	return path
+}
+
+// GraphiteKey returns the dotted path the metric is stored
+// under in graphite
+func (m *Metric) GraphiteKey(prefix string) string {
+	key := fmt.Sprintf("%s.%s.%s", m.Host, m.KeyPath(), m.Name)
 	if prefix != "" {
 		key = fmt.Sprintf("%s%s", prefix, key)
 	}
-	return fmt.Sprintf("%s %v %d", key, m.Value, int32(m.Timestamp.Unix()))
+	return key
 }
@@ -0,0 +1,179 @@
+package structs
+
+import "fmt"
+import "strings"
+import "sync"
+
+// NameTemplate builds the path of a metric from placeholders
+// such as {host|reverse_dns} or {tag:device}, for backends that
+// store metrics under a dotted path
+type NameTemplate struct {
+	text  string
+	parts []templatePart
+}
+
+type templatePart struct {
+	literal string
+	field   string
+	tag     string
+	filters []string
+}
+
+var templateFields = map[string]bool{
+	"prefix":    true,
+	"host":      true,
+	"collector": true,
+	"path":      true,
+	"name":      true,
+	"type":      true,
+}
+
+var templateFilters = map[string]func(string) string{
+	"lowercase":    strings.ToLower,
+	"uppercase":    strings.ToUpper,
+	"replace_dots": func(value string) string { return strings.Replace(value, ".", "_", -1) },
+	"reverse_dns":  reverseDNS,
+	"short":        func(value string) string { return strings.SplitN(value, ".", 2)[0] },
+}
+
+var templateValueReplacer = strings.NewReplacer(" ", "_", "\t", "_", "\n", "_")
+
+var templateCache = map[string]*NameTemplate{}
+var templateCacheMu sync.Mutex
+
+// ParseNameTemplate parses a naming template, returning an error
+// for unknown fields and filters or unbalanced braces
+func ParseNameTemplate(text string) (*NameTemplate, error) {
+	t := &NameTemplate{text: text}
+
+	rest := text
+	for rest != "" {
+		open := strings.Index(rest, "{")
+		literal := rest
+		if open >= 0 {
+			literal = rest[:open]
+		}
+		if strings.Contains(literal, "}") {
+			return nil, fmt.Errorf("unopened } in template %q", text)
+		}
+		if open < 0 {
+			t.parts = append(t.parts, templatePart{literal: rest})
+			break
+		}
+		if open > 0 {
+			t.parts = append(t.parts, templatePart{literal: rest[:open]})
+		}
+
+		end := strings.Index(rest[open:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed { in template %q", text)
+		}
+		placeholder := rest[open+1 : open+end]
+		rest = rest[open+end+1:]
+
+		filters := strings.Split(placeholder, "|")
+		part := templatePart{field: strings.TrimSpace(filters[0])}
+		if strings.HasPrefix(part.field, "tag:") {
+			part.tag = strings.TrimPrefix(part.field, "tag:")
+			part.field = "tag"
+		} else if !templateFields[part.field] {
+			return nil, fmt.Errorf("unknown field {%s} in template %q", part.field, text)
+		}
+		for _, filter := range filters[1:] {
+			filter = strings.TrimSpace(filter)
+			if _, ok := templateFilters[filter]; !ok {
+				return nil, fmt.Errorf("unknown filter %s in template %q", filter, text)
+			}
+			part.filters = append(part.filters, filter)
+		}
+		t.parts = append(t.parts, part)
+	}
+
+	return t, nil
+}
+
+// LookupNameTemplate returns the parsed template for text,
+// parsing each distinct template only once
+func LookupNameTemplate(text string) (*NameTemplate, error) {
+	templateCacheMu.Lock()
+	defer templateCacheMu.Unlock()
+
+	if t, ok := templateCache[text]; ok {
+		return t, nil
+	}
+	t, err := ParseNameTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+	templateCache[text] = t
+	return t, nil
+}
+
+// String returns the text the template was parsed from
+func (t *NameTemplate) String() string {
+	return t.text
+}
+
+// Render builds the path of a metric. Placeholders that have
+// no value, such as a missing tag or an unset prefix, are
+// dropped along with the dot that separates them.
+func (t *NameTemplate) Render(m *Metric, prefix string) string {
+	var rendered []string
+	for _, part := range t.parts {
+		if part.field == "" {
+			rendered = append(rendered, part.literal)
+			continue
+		}
+
+		value := templateValueReplacer.Replace(part.value(m, prefix))
+		for _, filter := range part.filters {
+			value = templateFilters[filter](value)
+		}
+		rendered = append(rendered, value)
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(strings.Join(rendered, ""), ".") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return strings.Join(segments, ".")
+}
+
+func (p templatePart) value(m *Metric, prefix string) string {
+	switch p.field {
+	case "prefix":
+		return prefix
+	case "host":
+		return m.Host
+	case "collector":
+		return m.From
+	case "path":
+		if m.Path != "" {
+			return m.Path
+		}
+		return m.From
+	case "name":
+		return m.Name
+	case "type":
+		return m.MetricType
+	case "tag":
+		for _, fields := range []FieldsMap{m.Data, m.Tags} {
+			if v, ok := fields[p.tag]; ok && v != nil {
+				return fmt.Sprintf("%v", v)
+			}
+		}
+	}
+	return ""
+}
+
+// reverseDNS reverses the segments of a hostname, so that
+// web1.example.com becomes com.example.web1
+func reverseDNS(host string) string {
+	segments := strings.Split(host, ".")
+	for i, j := 0, len(segments)-1; i < j; i, j = i+1, j-1 {
+		segments[i], segments[j] = segments[j], segments[i]
+	}
+	return strings.Join(segments, ".")
+}
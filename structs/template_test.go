@@ -0,0 +1,70 @@
+package structs
+
+import "testing"
+
+func TestNameTemplateRender(t *testing.T) {
+	metric := &Metric{
+		Host:       "Web1.example.com",
+		From:       "disk",
+		Path:       "disk.usage",
+		Name:       "used",
+		MetricType: "gauge",
+		Data:       FieldsMap{"device": "sda 1", "mountpoint": "/var/log"},
+		Tags:       FieldsMap{"role": "db"},
+	}
+
+	tests := []struct {
+		template string
+		prefix   string
+		want     string
+	}{
+		{"{host}.{path}.{name}", "", "Web1.example.com.disk.usage.used"},
+		{"{prefix}.{host|short}.{collector}.{name}", "metrics", "metrics.Web1.disk.used"},
+		{"{host|lowercase|reverse_dns}.{name}", "", "com.example.web1.used"},
+		{"{host|uppercase|replace_dots}.{type}", "", "WEB1_EXAMPLE_COM.gauge"},
+		{"{tag:device}.{tag:role}.{name}", "", "sda_1.db.used"},
+		{"{tag:mountpoint|replace_dots}", "", "/var/log"},
+		// placeholders without a value are dropped with their dot
+		{"{prefix}.{host|short}.{tag:missing}.{name}", "", "Web1.used"},
+		{"servers.{ host | short }.{name}", "", "servers.Web1.used"},
+		{"..{name}..", "", "used"},
+	}
+
+	for _, test := range tests {
+		template, err := ParseNameTemplate(test.template)
+		if err != nil {
+			t.Errorf("ParseNameTemplate(%q): %s", test.template, err)
+			continue
+		}
+		if got := template.Render(metric, test.prefix); got != test.want {
+			t.Errorf("Render(%q) = %q, want %q", test.template, got, test.want)
+		}
+	}
+}
+
+func TestNameTemplatePathFallsBackToCollector(t *testing.T) {
+	template, err := ParseNameTemplate("{path}.{name}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := template.Render(&Metric{From: "load", Name: "one"}, ""); got != "load.one" {
+		t.Errorf("Render = %q, want %q", got, "load.one")
+	}
+}
+
+func TestParseNameTemplateErrors(t *testing.T) {
+	tests := []string{
+		"{host}.{nope}",
+		"{host|nope}",
+		"{host}.{name",
+		"{host}.name}",
+		"host}.{name}",
+		"{host{name}}",
+	}
+
+	for _, text := range tests {
+		if _, err := ParseNameTemplate(text); err == nil {
+			t.Errorf("ParseNameTemplate(%q) returned no error", text)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import "fmt"
+import "sync/atomic"
+import "time"
+import "github.com/mike-a-davis/metricsd/stats"
+import "github.com/mike-a-davis/metricsd/structs"
+import "github.com/Sirupsen/logrus"
+
+type result struct {
+	data structs.MetricSlice
+	err  error
+}
+
+// collect runs the collector of a job under supervision and forwards
+// whatever it reported, attributed to the job's config section and
+// instance. Failures are logged and never stop other jobs.
+func (j *job) collect(c chan *structs.Metric) {
+	start := time.Now()
+	data, err := j.supervise()
+	stats.RecordCollect(j.name, time.Since(start), len(data), err)
+	if err != nil {
+		logrus.Warning(fmt.Sprintf("collector %s failed: %s", j.name, err))
+	}
+
+	for _, element := range data {
+		element.Collector = j.name
+		if j.instance != "" {
+			if element.Data == nil {
+				element.Data = structs.FieldsMap{}
+			}
+			element.Data["instance"] = j.instance
+		}
+		c <- element
+	}
+}
+
+// supervise calls Report on the collector, recovering from panics and
+// giving up after the job timeout. A run that timed out is left to
+// finish in the background, and the job is skipped until it does.
+func (j *job) supervise() (structs.MetricSlice, error) {
+	if !atomic.CompareAndSwapInt32(&j.running, 0, 1) {
+		return nil, fmt.Errorf("previous run still in progress")
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		defer atomic.StoreInt32(&j.running, 0)
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{err: fmt.Errorf("panic: %v", r)}
+			}
+		}()
+
+		data, err := j.collector.Report()
+		done <- result{data: data, err: err}
+	}()
+
+	timer := time.NewTimer(j.timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-done:
+		return r.data, r.err
+	case <-timer.C:
+		return nil, fmt.Errorf("timed out after %s", j.timeout)
+	}
+}
@@ -0,0 +1,65 @@
+package utils
+
+import "bytes"
+import "fmt"
+import "time"
+
+// Strftime replaces the %Y, %y, %m, %d, %H, %j and %% directives
+// in pattern with the matching parts of t. Other text, including
+// unknown directives, is kept as is.
+func Strftime(pattern string, t time.Time) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i == len(pattern)-1 {
+			buf.WriteByte(pattern[i])
+			continue
+		}
+
+		i++
+		switch pattern[i] {
+		case 'Y':
+			fmt.Fprintf(&buf, "%04d", t.Year())
+		case 'y':
+			fmt.Fprintf(&buf, "%02d", t.Year()%100)
+		case 'm':
+			fmt.Fprintf(&buf, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&buf, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&buf, "%02d", t.Hour())
+		case 'j':
+			fmt.Fprintf(&buf, "%03d", t.YearDay())
+		case '%':
+			buf.WriteByte('%')
+		default:
+			buf.WriteByte('%')
+			buf.WriteByte(pattern[i])
+		}
+	}
+	return buf.String()
+}
+
+// StrftimeGlob replaces the directives Strftime knows in pattern
+// with *, giving a wildcard pattern that matches every name
+// Strftime can make from it.
+func StrftimeGlob(pattern string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i == len(pattern)-1 {
+			buf.WriteByte(pattern[i])
+			continue
+		}
+
+		i++
+		switch pattern[i] {
+		case 'Y', 'y', 'm', 'd', 'H', 'j':
+			buf.WriteByte('*')
+		case '%':
+			buf.WriteByte('%')
+		default:
+			buf.WriteByte('%')
+			buf.WriteByte(pattern[i])
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,46 @@
+package utils
+
+import "testing"
+import "time"
+
+func TestStrftime(t *testing.T) {
+	at := time.Date(2024, time.February, 5, 7, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"metricsd-%Y.%m.%d", "metricsd-2024.02.05"},
+		{"metricsd-%y%m%d-%H", "metricsd-240205-07"},
+		{"day-%j", "day-036"},
+		{"100%%", "100%"},
+		// unknown directives and a trailing % are kept as is
+		{"%Q-%Y", "%Q-2024"},
+		{"metricsd%", "metricsd%"},
+		{"metricsd-data", "metricsd-data"},
+	}
+
+	for _, test := range tests {
+		if got := Strftime(test.pattern, at); got != test.want {
+			t.Errorf("Strftime(%q) = %q, want %q", test.pattern, got, test.want)
+		}
+	}
+}
+
+func TestStrftimeGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"metricsd-%Y.%m.%d", "metricsd-*.*.*"},
+		{"metricsd-%y%j%H", "metricsd-***"},
+		{"metricsd-%Q%", "metricsd-%Q%"},
+		{"metricsd-data", "metricsd-data"},
+	}
+
+	for _, test := range tests {
+		if got := StrftimeGlob(test.pattern); got != test.want {
+			t.Errorf("StrftimeGlob(%q) = %q, want %q", test.pattern, got, test.want)
+		}
+	}
+}